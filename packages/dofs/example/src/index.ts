@@ -9,7 +9,10 @@ export class MyDurableObjectBase extends DurableObject<Env> {
   }
 }
 
-export class MyDurableObjectWithDofsMixin extends withDofs(MyDurableObjectBase, { chunkSize: 4 * 1024 }) {
+export class MyDurableObjectWithDofsMixin extends withDofs(MyDurableObjectBase, {
+  chunkSize: 4 * 1024,
+  tiering: { bucket: 'DOFS_COLD', minAgeMs: 60 * 1000, minSize: 64 * 1024 },
+}) {
   constructor(ctx: DurableObjectState, env: Env) {
     super(ctx, env)
   }
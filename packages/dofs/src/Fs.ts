@@ -1,23 +1,103 @@
 import { RpcTarget } from 'cloudflare:workers'
+import { ensureAlarmTable, scheduleAlarm } from './alarm.js'
+import { decodeCursor, encodeCursor } from './cursor.js'
+import { FsError, isFsError } from './FsError.js'
+import { globToRegExp, splitGlob, toSqlGlob } from './glob.js'
+import { FsMetrics, MetricsRecorder } from './metrics.js'
+import { detectContentType } from './mime.js'
+import {
+  PathOptions,
+  foldName,
+  joinPath,
+  normalizePath,
+  parsePath,
+  splitPath,
+  validateName,
+  validateTarget,
+} from './path.js'
+import { sha256 } from './sha256.js'
 
 export type CreateOptions = { mode?: number; umask?: number }
+export type SpecialKind = 'NamedPipe' | 'Socket' | 'CharDevice' | 'BlockDevice'
+export type MknodOptions = CreateOptions & {
+  kind: SpecialKind | 'File'
+  /** Device number of a CharDevice or BlockDevice, see makedev() */
+  rdev?: number
+}
+export type FollowOptions = {
+  /** Follow a symlink at the end of the path (default true); with false, act on the link or fail with ELOOP */
+  followSymlinks?: boolean
+}
 export type DeviceStats = {
   deviceSize: number
   spaceUsed: number
   spaceAvailable: number
+  /** Bytes of file data moved to R2, when tiering is enabled */
+  tieredBytes?: number
+}
+export type ReadFileOptions = {
+  encoding?: string
+  /** Read a previous version from listVersions() instead of the current content */
+  version?: number
+  /** Check each chunk against its checksum, failing the stream with EIO on a mismatch */
+  verify?: boolean
+}
+export type WriteFileOptions = FollowOptions & {
+  encoding?: string
+  /** Delete the file this long after the write */
+  ttlMs?: number
+  /** Keep an existing file's expiry when rewriting it without ttlMs, instead of clearing it */
+  keepExpiry?: boolean
+  /** MIME type to store, instead of detecting it from the name and content */
+  contentType?: string
 }
-export type ReadFileOptions = { encoding?: string }
-export type WriteFileOptions = { encoding?: string }
 export type ReadOptions = { offset?: number; length?: number; encoding?: string }
-export type WriteOptions = { offset?: number; encoding?: string }
+export type WriteOptions = { offset?: number; encoding?: string } & FollowOptions
 export type MkdirOptions = { recursive?: boolean } & CreateOptions
-export type RmdirOptions = { recursive?: boolean }
+export type RmdirOptions = {
+  recursive?: boolean
+  /** Delete immediately even when the trash is enabled */
+  permanent?: boolean
+}
+export type UnlinkOptions = {
+  /** Delete immediately even when the trash is enabled */
+  permanent?: boolean
+}
 export type ListDirOptions = { recursive?: boolean }
-export type SetAttrOptions = { mode?: number; uid?: number; gid?: number }
+export type ReaddirSort = 'name' | 'mtime' | 'size'
+export type ReaddirOptions = {
+  /** Include each entry's attributes, read in the same query */
+  withStats?: boolean
+  limit?: number
+  cursor?: string
+  /** Ascending order, ties broken by name (default 'name'); anything else fails with EINVAL */
+  sort?: ReaddirSort
+}
+export type DirEntry = { name: string; ino: number; kind: string; stat?: Stat }
+export type ReaddirResult = { entries: DirEntry[]; cursor?: string }
+export type RenameOptions = {
+  /** Fail with EEXIST instead of replacing an existing destination (RENAME_NOREPLACE) */
+  noReplace?: boolean
+  /** Atomically swap two existing entries, which may be of different types (RENAME_EXCHANGE) */
+  exchange?: boolean
+}
+export type CopyFileOptions = {
+  /** Replace an existing destination (default true) */
+  overwrite?: boolean
+}
+export type CpOptions = CopyFileOptions & {
+  /** Copy directories and their contents */
+  recursive?: boolean
+  /** Keep timestamps, and ownership when called as root */
+  preserve?: boolean
+}
+export type SetAttrOptions = { mode?: number; uid?: number; gid?: number } & FollowOptions
+export type Credentials = { uid: number; gid: number; groups?: number[] }
 export type Stat = {
   isFile: boolean
   isDirectory: boolean
   size: number
+  ino?: number
   mode?: number
   uid?: number
   gid?: number
@@ -31,70 +111,449 @@ export type Stat = {
   flags?: number
   blksize?: number
   kind?: string
+  /** Hash of the file's chunk checksums, when checksums are enabled */
+  digest?: string
+  /** When the entry will be deleted, if it has an expiry */
+  expiresAt?: number
+  /** MIME type of a file, given to writeFile() or detected from its name and first bytes */
+  contentType?: string
+  /** Changes if the inode number is ever handed out again, so (ino, generation) identifies one file for good */
+  generation?: number
+}
+
+export type FileType = 'file' | 'directory' | 'symlink' | 'fifo' | 'socket' | 'charDevice' | 'blockDevice'
+export type FindOptions = {
+  /** Glob matched against entry names (not full paths) */
+  name?: string
+  type?: FileType
+  minSize?: number
+  maxSize?: number
+  /** Only entries with an mtime after this time (ms since epoch) */
+  modifiedAfter?: number
+  /** How many levels below the root to descend; 1 lists only direct children */
+  maxDepth?: number
+  limit?: number
+  cursor?: string
+}
+export type GlobOptions = { limit?: number; cursor?: string }
+export type FindEntry = { path: string; stat: Stat }
+export type FindResult = { entries: FindEntry[]; cursor?: string }
+export type DuOptions = {
+  /** Report subdirectories up to this depth below the root (default unlimited, 0 reports only the root) */
+  maxDepth?: number
+}
+export type DuEntry = { path: string; bytes: number; inodes: number }
+export type SearchOptions = {
+  /** Only search files below this directory */
+  path?: string
+  limit?: number
+  /** Markers placed around matched terms in snippets */
+  highlight?: [string, string]
+}
+export type SearchResult = { path: string; snippet: string; rank: number }
+
+export type TrashOptions = {
+  /** Purge entries this long after deletion. Without it, entries stay until emptyTrash() */
+  retentionMs?: number
+}
+export type TrashEntry = { id: number; path: string; deletedAt: number; stat: Stat }
+export type EmptyTrashOptions = {
+  /** Only purge entries deleted before this time */
+  olderThan?: number | Date
+}
+export type VersioningOptions = {
+  /** Versions kept per file (default 10) */
+  maxVersions?: number
+  /** Drop versions this long after they were replaced */
+  maxAgeMs?: number
+}
+export type FileVersion = { version: number; size: number; mtime: number; createdAt: number }
+export type AuditOptions = {
+  /** Entries kept before the oldest are dropped (default 100000) */
+  maxEntries?: number
+  /** Also drop entries older than this */
+  retentionMs?: number
+  /** Log reads like readFile and stat too, not just changes */
+  reads?: boolean
+}
+export type CallContext = {
+  /** Who is making the calls, e.g. a user id from your auth layer, recorded in the audit log */
+  actor?: string
+}
+export type AuditEntry = {
+  id: number
+  at: number
+  actor?: string
+  uid: number
+  method: string
+  path: string
+  dest?: string
+  /** File bytes read or written during the call */
+  bytes: number
+  /** 'ok', or the error code the call failed with */
+  result: string
+}
+export type AuditLogOptions = {
+  since?: number | Date
+  /** Entries whose path or destination is this path or inside it */
+  path?: string
+  actor?: string
+  limit?: number
+  cursor?: string
+}
+export type AuditLogResult = { entries: AuditEntry[]; cursor?: string }
+export type ChecksumOptions = {
+  /** Hash function for chunks and digests, returning a string (default SHA-256 hex) */
+  hash?: (data: Uint8Array) => string
 }
+export type VerifyResult = { ok: boolean; digest?: string; corruptOffsets: number[] }
+export type TieringOptions = {
+  /** R2 bucket for cold chunks, or the name of its binding in env */
+  bucket: R2Bucket | string
+  /** Prefix for object keys (default 'dofs/') */
+  prefix?: string
+  /** Only tier files not modified for this long (default 7 days); old versions are tiered after this long too */
+  minAgeMs?: number
+  /** Only tier files at least this large (default 1 MiB) */
+  minSize?: number
+  /** Only tier files not read for this long (default minAgeMs); relies on access times being recorded */
+  idleMs?: number
+  /** How often the alarm looks for cold files (default 1 hour) */
+  intervalMs?: number
+}
+export type TierOptions = {
+  /** Maximum number of chunks to move (default 100) */
+  limit?: number
+}
+export type FsckOptions = {
+  /** Fix what is found. Unreachable inodes move to /lost+found; sizes and space_used are recomputed */
+  repair?: boolean
+  /** Run in slices from the Durable Object's alarm instead of all at once; poll fsckStatus() for the report */
+  background?: boolean
+}
+export type FsckIssueKind =
+  | 'orphanChunks'
+  | 'missingParent'
+  | 'cycle'
+  | 'sizeMismatch'
+  | 'spaceUsedMismatch'
+  | 'inodeCounter'
+export type FsckIssue = { kind: FsckIssueKind; ino?: number; expected?: number; actual?: number; repaired: boolean }
+export type FsckReport = { done: boolean; repair: boolean; issues: FsckIssue[] }
+type FsckState = FsckReport & { phase: 'tree' | 'chunks' | 'sizes' | 'space'; after: number }
+// strict updates atime on every read, relatime only when it is older than mtime/ctime or a day old,
+// noatime never updates it (saving a write per read)
+export type AtimePolicy = 'strict' | 'relatime' | 'noatime'
 
 export type FsOptions = {
   chunkSize?: number
+  credentials?: Credentials
+  atime?: AtimePolicy
+  /** Maintain an FTS5 index of text file contents for search() */
+  indexText?: boolean
+  /** Move unlinked files and removed directories to a trash they can be restored from */
+  trash?: boolean | TrashOptions
+  /** Keep the previous content when a file is overwritten, truncated or replaced by rename */
+  versioning?: boolean | VersioningOptions
+  /** Store a checksum per chunk and a whole-file digest */
+  checksums?: boolean | ChecksumOptions
+  /** Keep this filesystem in its own tables (dofs_<volume>_*), so several can share a Durable Object */
+  volume?: string
+  /** Move chunks of cold files to R2, fetching them back transparently when read */
+  tiering?: TieringOptions
+  /** How names are normalized and matched, e.g. to behave like a case-insensitive macOS volume */
+  paths?: PathOptions
+  /** Record who changed what in a rotating dofs_audit table, read with getAuditLog() */
+  audit?: boolean | AuditOptions
+  /** Identity of the caller, see withContext() */
+  context?: CallContext
+}
+
+// Device numbers in Linux's encoding, as FUSE passes them: 12 bits of major and 20 of minor
+export const makedev = (major: number, minor: number) =>
+  ((minor & 0xff) | ((major & 0xfff) << 8) | ((minor & ~0xff) << 12)) >>> 0
+export const major = (rdev: number) => (rdev >>> 8) & 0xfff
+export const minor = (rdev: number) => (rdev & 0xff) | ((rdev >>> 12) & 0xfff00)
+
+// Access modes for access(), matching the POSIX constants
+export const F_OK = 0
+export const R_OK = 4
+export const W_OK = 2
+export const X_OK = 1
+
+const S_ISVTX = 0o1000
+const S_ISGID = 0o2000
+// Symlinks followed while resolving one path before giving up with ELOOP, as on Linux
+const MAX_SYMLINKS = 40
+const RELATIME_INTERVAL = 24 * 60 * 60 * 1000
+const DEFAULT_PAGE_SIZE = 1000
+const DEFAULT_MAX_VERSIONS = 10
+const DEFAULT_AUDIT_MAX_ENTRIES = 100000
+// Old audit entries are dropped once every this many entries rather than on each one
+const AUDIT_ROTATE_INTERVAL = 100
+// Rows fsck examines per slice
+const FSCK_SLICE_SIZE = 1000
+// Expired entries deleted per alarm; the alarm fires again right away if more are due
+const EXPIRE_BATCH_SIZE = 100
+// How long an expired entry that failed to delete waits before the next attempt
+const EXPIRE_RETRY_DELAY = 60 * 1000
+// Larger files are left out of the text index, since every write re-reads the whole file
+const TEXT_INDEX_MAX_SIZE = 1024 * 1024
+// Chunks uploaded, or orphaned objects deleted, per tiering run; also the most keys bound in one query
+const TIER_BATCH_SIZE = 100
+const DEFAULT_TIER_MIN_AGE = 7 * 24 * 60 * 60 * 1000
+const DEFAULT_TIER_MIN_SIZE = 1024 * 1024
+const DEFAULT_TIER_INTERVAL = 60 * 60 * 1000
+
+// Methods that change the filesystem, which the audit log records
+const MUTATING_METHODS = new Set([
+  'writeFile',
+  'write',
+  'truncate',
+  'create',
+  'mknod',
+  'mkdir',
+  'rmdir',
+  'unlink',
+  'rename',
+  'symlink',
+  'copyFile',
+  'cp',
+  'setattr',
+  'utimes',
+  'setExpiry',
+  'revert',
+  'restore',
+  'emptyTrash',
+  'fsck',
+  'rebuildTextIndex',
+  'tier',
+  'recall',
+])
+
+// Node's syscall names, used in error messages, for methods named differently
+const SYSCALLS: Record<string, string> = {
+  readFile: 'open',
+  writeFile: 'open',
+  create: 'open',
+  listDir: 'scandir',
+  readdir: 'scandir',
+  statInode: 'stat',
+  utimes: 'utime',
+  copyFile: 'copyfile',
+}
+
+const kindForType: Record<FileType, string> = {
+  file: 'File',
+  directory: 'Directory',
+  symlink: 'Symlink',
+  fifo: 'NamedPipe',
+  socket: 'Socket',
+  charDevice: 'CharDevice',
+  blockDevice: 'BlockDevice',
+}
+
+// SQL for each readdir sort key; sort comes from callers, so it is never pasted into a query itself
+const sortKeys: Record<ReaddirSort, string> = {
+  name: 'name',
+  mtime: "json_extract(attr, '$.mtime')",
+  size: "json_extract(attr, '$.size')",
+}
+
+const SPECIAL_KINDS = new Set<string>(['NamedPipe', 'Socket', 'CharDevice', 'BlockDevice'])
+
+// FIFOs, sockets and device nodes have no content in dofs; opening one fails with ENXIO, as with no driver or peer
+const isSpecial = (kind: string) => SPECIAL_KINDS.has(kind)
+
+type TreeQuery = FindOptions & { minDepth?: number }
+
+// The tables of one filesystem. A named volume has its own set, prefixed dofs_<volume>_, as do its indexes and
+// triggers, which are named after their table.
+const tableNames = (volume?: string) => {
+  const prefix = volume === undefined ? 'dofs_' : `dofs_${volume}_`
+  return {
+    meta: `${prefix}meta`,
+    files: `${prefix}files`,
+    chunks: `${prefix}chunks`,
+    trash: `${prefix}trash`,
+    versions: `${prefix}versions`,
+    text: `${prefix}text`,
+    tierOrphans: `${prefix}tier_orphans`,
+    audit: `${prefix}audit`,
+  }
 }
 
+// view() passes the filesystem a view is of under this key, which callers can't
+const PARENT = Symbol('parent')
+type ViewOptions = FsOptions & { [PARENT]?: Fs }
+
 export class Fs extends RpcTarget {
   protected ctx: DurableObjectState
   protected env: Env
   protected chunkSize: number
+  protected options: FsOptions
+  protected credentials: Credentials
+  protected atimePolicy: AtimePolicy
+  protected tables: ReturnType<typeof tableNames>
+  // SQL storage, counting each statement towards the running method
+  protected sql: Pick<SqlStorage, 'exec'>
+  private deferredReindex = new Set<number>()
+  private metrics = new MetricsRecorder()
+  // The outermost method running synchronously, which its SQL statements and nested calls are charged to
+  private activeMethod: string | undefined
 
   constructor(ctx: DurableObjectState, env: Env, options?: FsOptions) {
     super()
     this.env = env
     this.ctx = ctx
+    this.options = options ?? {}
     this.chunkSize = options?.chunkSize ?? 64 * 1024 // 64kb
+    this.credentials = options?.credentials ?? { uid: 0, gid: 0 }
+    this.atimePolicy = options?.atime ?? 'relatime'
+    const volume = options?.volume
+    if (volume !== undefined && !/^[A-Za-z0-9_]+$/.test(volume)) throw new FsError('EINVAL', 'volume', volume)
+    this.tables = tableNames(volume)
+    this.sql = {
+      exec: <T extends Record<string, SqlStorageValue>>(query: string, ...bindings: any[]) => {
+        this.metrics.query(this.activeMethod)
+        return ctx.storage.sql.exec<T>(query, ...bindings)
+      },
+    }
+    const parent = (options as ViewOptions | undefined)?.[PARENT]
+    if (parent) {
+      // A view shares its filesystem's schema, alarm and counters, which are already set up
+      this.metrics = parent.metrics
+      this.deferredReindex = parent.deferredReindex
+      return
+    }
     this.ctx.blockConcurrencyWhile(async () => {
       this.ensureSchema()
+      this.scheduleNextAlarm()
+    })
+  }
+
+  private view(options: FsOptions) {
+    const viewOptions: ViewOptions = { ...this.options, ...options, [PARENT]: this }
+    return new Fs(this.ctx, this.env, viewOptions)
+  }
+
+  // Returns a view of this filesystem that acts as the given caller. Root only, or any view could make itself root
+  public withCredentials(credentials: Credentials) {
+    if (this.credentials.uid !== 0) throw new FsError('EPERM', 'withCredentials')
+    return this.view({ credentials })
+  }
+
+  // Returns a view of this filesystem whose calls are attributed to context.actor in the audit log. Root only, so
+  // callers can't change who their calls are attributed to.
+  public withContext(context: CallContext) {
+    if (this.credentials.uid !== 0) throw new FsError('EPERM', 'withContext')
+    return this.view({ context })
+  }
+
+  // Counts of calls, errors, bytes and SQL statements per method since the Durable Object started
+  public getMetrics(): FsMetrics {
+    return this.metrics.snapshot(this.options.volume)
+  }
+
+  // Audit entries oldest first, in pages. Root only
+  public getAuditLog(options?: AuditLogOptions): AuditLogResult {
+    return this.run('getAuditLog', options?.path ?? '/', () => {
+      if (this.credentials.uid !== 0) throw new FsError('EPERM')
+      const limit = options?.limit ?? DEFAULT_PAGE_SIZE
+      const filters = ['id > ?']
+      const params: (string | number)[] = [options?.cursor ? this.readCursor<number>(options.cursor) : 0]
+      if (options?.since !== undefined) {
+        filters.push('at >= ?')
+        params.push(Number(options.since))
+      }
+      if (options?.actor !== undefined) {
+        filters.push('actor = ?')
+        params.push(options.actor)
+      }
+      const path = options?.path === undefined ? '/' : this.auditPath(options.path)
+      if (path !== '/') {
+        // '0' sorts right after '/', so the range holds exactly the paths below
+        filters.push('(path = ? OR (path > ? AND path < ?) OR dest = ? OR (dest > ? AND dest < ?))')
+        params.push(path, path + '/', path + '0', path, path + '/', path + '0')
+      }
+      const rows = this.sql
+        .exec(`SELECT * FROM ${this.tables.audit} WHERE ${filters.join(' AND ')} ORDER BY id LIMIT ?`, ...params, limit)
+        .toArray()
+      const entries = rows.map(
+        (row): AuditEntry => ({
+          id: Number(row.id),
+          at: Number(row.at),
+          actor: row.actor === null ? undefined : String(row.actor),
+          uid: Number(row.uid),
+          method: String(row.method),
+          path: String(row.path),
+          dest: row.dest === null ? undefined : String(row.dest),
+          bytes: Number(row.bytes),
+          result: String(row.result),
+        })
+      )
+      if (rows.length < limit) return { entries }
+      return { entries, cursor: encodeCursor(entries[entries.length - 1].id) }
     })
   }
 
   public readFile(path: string, options?: ReadFileOptions) {
-    const ino = this.resolvePathToInode(path)
-    // Get file size
-    const statCursor = this.ctx.storage.sql.exec('SELECT attr FROM dofs_files WHERE ino = ?', ino)
-    const statRow = statCursor.next().value
-    if (!statRow || !statRow.attr) throw new Error('ENOENT')
-    const attr = typeof statRow.attr === 'string' ? JSON.parse(statRow.attr) : statRow.attr
-    const fileSize = attr.size || 0
-    let currentOffset = 0
-    const self = this
-    return new ReadableStream<Uint8Array>({
-      pull(controller) {
-        console.log('pull', { currentOffset, fileSize })
-        if (currentOffset >= fileSize) {
-          controller.close()
-          return
-        }
-        const readLength = Math.min(self.chunkSize, fileSize - currentOffset)
-        // Read chunk from DB
-        const chunkCursor = self.ctx.storage.sql.exec(
-          'SELECT data FROM dofs_chunks WHERE ino = ? AND offset = ? LIMIT 1',
-          ino,
-          currentOffset
-        )
-        const chunkRow = chunkCursor.next().value
-        let chunk: Uint8Array
-        if (chunkRow && chunkRow.data) {
-          if (chunkRow.data instanceof ArrayBuffer) {
-            chunk = new Uint8Array(chunkRow.data)
-          } else if (ArrayBuffer.isView(chunkRow.data)) {
-            chunk = new Uint8Array(chunkRow.data.buffer)
-          } else if (typeof chunkRow.data === 'string') {
-            chunk = Uint8Array.from(chunkRow.data)
+    return this.run('readFile', path, () => {
+      const ino = this.resolvePathToInode(path)
+      // Get file size
+      const attr = this.readAttr(ino)
+      if (attr.kind === 'Directory') throw new FsError('EISDIR')
+      if (isSpecial(attr.kind)) throw new FsError('ENXIO')
+      this.checkAccess(attr, R_OK)
+      this.touchAtime(ino, attr)
+      // A version's chunks are stored under the negated version id
+      const version = options?.version === undefined ? undefined : this.readVersion(ino, options.version)
+      const dataIno = version ? -version.version : ino
+      const fileSize = version ? version.size : attr.size || 0
+      const verify = !!options?.verify && !!this.options.checksums
+      let currentOffset = 0
+      const self = this
+      return new ReadableStream<Uint8Array>({
+        async pull(controller) {
+          console.log('pull', { currentOffset, fileSize })
+          if (currentOffset >= fileSize) {
+            controller.close()
+            return
+          }
+          const readLength = Math.min(self.chunkSize, fileSize - currentOffset)
+          // Read chunk from DB
+          const chunkCursor = self.sql.exec(
+            `SELECT data, checksum, location FROM ${self.tables.chunks} WHERE ino = ? AND offset = ? LIMIT 1`,
+            dataIno,
+            currentOffset
+          )
+          const chunkRow = chunkCursor.next().value
+          let chunk: Uint8Array
+          if (chunkRow && chunkRow.location != null) {
+            chunk = await self.fetchChunk(String(chunkRow.location))
+          } else if (chunkRow && chunkRow.data) {
+            if (chunkRow.data instanceof ArrayBuffer) {
+              chunk = new Uint8Array(chunkRow.data)
+            } else if (ArrayBuffer.isView(chunkRow.data)) {
+              chunk = new Uint8Array(chunkRow.data.buffer)
+            } else if (typeof chunkRow.data === 'string') {
+              chunk = Uint8Array.from(chunkRow.data)
+            } else {
+              chunk = new Uint8Array(0)
+            }
           } else {
             chunk = new Uint8Array(0)
           }
-        } else {
-          chunk = new Uint8Array(0)
-        }
-        console.log('chunk', { chunk })
-        controller.enqueue(chunk)
-        currentOffset += readLength
-      },
+          console.log('chunk', { chunk })
+          if (verify && chunkRow?.checksum != null && self.checksum(chunk) !== chunkRow.checksum) {
+            controller.error(new FsError('EIO', 'read', path))
+            return
+          }
+          controller.enqueue(chunk)
+          self.metrics.bytesRead += chunk.length
+          currentOffset += readLength
+        },
+      })
     })
   }
 
@@ -103,108 +562,154 @@ export class Fs extends RpcTarget {
     data: ArrayBuffer | string | ReadableStream<Uint8Array>,
     options?: WriteFileOptions
   ) {
-    // Try to unlink if exists
-    try {
-      this.unlink(path)
-    } catch (e: any) {
-      if (!(e instanceof Error && e.message === 'ENOENT')) throw e
-    }
-    // Check available space before creating
-    const deviceSize = this.getDeviceSize()
-    const spaceUsed = this.getSpaceUsed()
-    // Create the file
-    this.create(path)
-    // Handle streaming upload
-    if (typeof data === 'object' && data !== null && typeof (data as any).getReader === 'function') {
-      // Stream case
-      const CHUNK_SIZE = 1024 * 1024 // 1MB
-      let offset = 0
-      let total = 0
-      const reader = (data as ReadableStream<Uint8Array>).getReader()
-      while (true) {
-        const { value, done } = await reader.read()
-        if (done) break
-        if (!value) continue
-        if (spaceUsed + total + value.length > deviceSize) {
-          throw Object.assign(new Error('ENOSPC'), { code: 'ENOSPC' })
-        }
-        // Write chunk
-        this.write(path, value, { offset, encoding: options?.encoding })
-        offset += value.length
-        total += value.length
-      }
-      return
-    }
-    // Buffer or string case
-    if (typeof data === 'string') {
-      const buf = new TextEncoder().encode(data)
-      if (spaceUsed + buf.length > deviceSize) {
-        throw Object.assign(new Error('ENOSPC'), { code: 'ENOSPC' })
-      }
-      this.write(path, buf, { offset: 0, encoding: options?.encoding })
-      return
-    }
-    if (data instanceof ArrayBuffer) {
-      const buf = new Uint8Array(data)
-      if (spaceUsed + buf.length > deviceSize) {
-        throw Object.assign(new Error('ENOSPC'), { code: 'ENOSPC' })
+    return this.run('writeFile', path, async () => {
+      // Truncate if exists, keeping the inode and its ownership, otherwise create it
+      const follow = { followSymlinks: options?.followSymlinks }
+      let existed = true
+      try {
+        // Truncating to zero never has a chunk to bring back from R2, so this finishes synchronously
+        this.truncateData(path, 0, follow)
+      } catch (e) {
+        if (!isFsError(e, 'ENOENT')) throw e
+        this.create(options?.followSymlinks === false ? path : this.danglingTarget(path))
+        existed = false
       }
-      this.write(path, buf, { offset: 0, encoding: options?.encoding })
-      return
-    }
-    if (ArrayBuffer.isView(data)) {
-      const buf = new Uint8Array(data.buffer)
-      if (spaceUsed + buf.length > deviceSize) {
-        throw Object.assign(new Error('ENOSPC'), { code: 'ENOSPC' })
+      if (options?.ttlMs !== undefined) this.setExpiry(path, Date.now() + options.ttlMs, follow)
+      // Index and hash once the whole file is written rather than after every chunk
+      const ino = this.resolvePathToInode(path, options?.followSymlinks ?? true)
+      // New content starts a new lifetime, so the old expiry goes too
+      if (existed && options?.ttlMs === undefined && !options?.keepExpiry) this.clearExpiry(ino)
+      if (options?.contentType) this.setContentType(ino, options.contentType)
+      this.deferredReindex.add(ino)
+      try {
+        // Check available space
+        const deviceSize = this.getDeviceSize()
+        const spaceUsed = this.getSpaceUsed()
+        // Handle streaming upload
+        if (typeof data === 'object' && data !== null && typeof (data as any).getReader === 'function') {
+          // Stream case
+          const CHUNK_SIZE = 1024 * 1024 // 1MB
+          let offset = 0
+          let total = 0
+          const reader = (data as ReadableStream<Uint8Array>).getReader()
+          while (true) {
+            const { value, done } = await reader.read()
+            if (done) break
+            if (!value) continue
+            if (spaceUsed + total + value.length > deviceSize) {
+              throw new FsError('ENOSPC')
+            }
+            // Write chunk
+            await this.writeData(path, value, { offset, encoding: options?.encoding, ...follow })
+            offset += value.length
+            total += value.length
+          }
+          return
+        }
+        // Buffer or string case
+        if (typeof data === 'string') {
+          const buf = new TextEncoder().encode(data)
+          if (spaceUsed + buf.length > deviceSize) {
+            throw new FsError('ENOSPC')
+          }
+          await this.writeData(path, buf, { offset: 0, encoding: options?.encoding, ...follow })
+          return
+        }
+        if (data instanceof ArrayBuffer) {
+          const buf = new Uint8Array(data)
+          if (spaceUsed + buf.length > deviceSize) {
+            throw new FsError('ENOSPC')
+          }
+          await this.writeData(path, buf, { offset: 0, encoding: options?.encoding, ...follow })
+          return
+        }
+        if (ArrayBuffer.isView(data)) {
+          const buf = new Uint8Array(data.buffer)
+          if (spaceUsed + buf.length > deviceSize) {
+            throw new FsError('ENOSPC')
+          }
+          await this.writeData(path, buf, { offset: 0, encoding: options?.encoding, ...follow })
+          return
+        }
+        throw new FsError('EINVAL')
+      } finally {
+        this.deferredReindex.delete(ino)
+        this.reindex(ino)
       }
-      this.write(path, buf, { offset: 0, encoding: options?.encoding })
-      return
-    }
-    throw new Error('Unsupported data type for writeFile')
+    })
   }
 
-  public read(path: string, options: ReadOptions) {
-    const ino = this.resolvePathToInode(path)
-    const offset = options?.offset ?? 0
-    const length = options?.length ?? undefined
-    const cursor = this.ctx.storage.sql.exec(
-      'SELECT offset, data, length FROM dofs_chunks WHERE ino = ? ORDER BY offset ASC',
-      ino
-    )
-    let chunks: { offset: number; data: Uint8Array }[] = []
-    let fileEnd = 0
-    for (let row of cursor) {
-      if (row.data && (row.data instanceof ArrayBuffer || ArrayBuffer.isView(row.data))) {
-        const arr = row.data instanceof ArrayBuffer ? new Uint8Array(row.data) : new Uint8Array(row.data.buffer)
-        chunks.push({ offset: Number(row.offset), data: arr })
-        fileEnd = Math.max(fileEnd, Number(row.offset) + arr.length)
-      }
-    }
-    const end = length !== undefined ? offset + length : fileEnd
-    const result = new Uint8Array(end - offset)
-    for (const chunk of chunks) {
-      const chunkStart = chunk.offset
-      const chunkEnd = chunk.offset + chunk.data.length
-      const readStart = Math.max(offset, chunkStart)
-      const readEnd = Math.min(end, chunkEnd)
-      if (readStart < readEnd) {
-        const destStart = readStart - offset
-        const srcStart = readStart - chunkStart
-        const len = readEnd - readStart
-        result.set(chunk.data.subarray(srcStart, srcStart + len), destStart)
+  public async read(path: string, options: ReadOptions): Promise<ArrayBuffer> {
+    return this.run('read', path, () => {
+      const ino = this.resolvePathToInode(path)
+      const attr = this.readAttr(ino)
+      if (attr.kind === 'Directory') throw new FsError('EISDIR')
+      if (isSpecial(attr.kind)) throw new FsError('ENXIO')
+      this.checkAccess(attr, R_OK)
+      this.touchAtime(ino, attr)
+      const offset = options?.offset ?? 0
+      const length = options?.length ?? undefined
+      const rows = this.sql
+        .exec(`SELECT offset, data, length, location FROM ${this.tables.chunks} WHERE ino = ? ORDER BY offset ASC`, ino)
+        .toArray()
+      const assemble = () => {
+        let chunks: { offset: number; data: Uint8Array }[] = []
+        let fileEnd = 0
+        for (let row of rows) {
+          if (row.data && (row.data instanceof ArrayBuffer || ArrayBuffer.isView(row.data))) {
+            const arr = row.data instanceof ArrayBuffer ? new Uint8Array(row.data) : new Uint8Array(row.data.buffer)
+            chunks.push({ offset: Number(row.offset), data: arr })
+            fileEnd = Math.max(fileEnd, Number(row.offset) + arr.length)
+          }
+        }
+        const end = length !== undefined ? offset + length : fileEnd
+        const result = new Uint8Array(end - offset)
+        for (const chunk of chunks) {
+          const chunkStart = chunk.offset
+          const chunkEnd = chunk.offset + chunk.data.length
+          const readStart = Math.max(offset, chunkStart)
+          const readEnd = Math.min(end, chunkEnd)
+          if (readStart < readEnd) {
+            const destStart = readStart - offset
+            const srcStart = readStart - chunkStart
+            const len = readEnd - readStart
+            result.set(chunk.data.subarray(srcStart, srcStart + len), destStart)
+          }
+        }
+        this.metrics.bytesRead += result.length
+        return result.buffer
       }
-    }
-    return result.buffer
+      // Chunks in R2 that overlap the range have to be fetched first
+      const tiered = rows.filter(
+        (row) =>
+          row.location != null &&
+          Number(row.offset) + Number(row.length) > offset &&
+          (length === undefined || Number(row.offset) < offset + length)
+      )
+      if (tiered.length === 0) return assemble()
+      return Promise.all(
+        tiered.map(async (row) => {
+          row.data = await this.fetchChunk(String(row.location))
+        })
+      ).then(assemble)
+    })
+  }
+
+  public async write(path: string, data: ArrayBuffer | string, options: WriteOptions) {
+    await this.run('write', path, () => this.writeData(path, data, options))
   }
 
-  public write(path: string, data: ArrayBuffer | string, options: WriteOptions) {
+  // write() without run(), for writeFile's chunks: a streamed writeFile's later chunks are written after run()
+  // returned, and would otherwise count as calls of their own
+  private writeData(path: string, data: ArrayBuffer | string, options: WriteOptions): void | Promise<void> {
+    const follow = options?.followSymlinks ?? true
     let ino: number
     try {
-      ino = this.resolvePathToInode(path)
-    } catch (e: any) {
-      if (e instanceof Error && e.message === 'ENOENT') {
+      ino = this.resolvePathToInode(path, follow)
+    } catch (e) {
+      if (isFsError(e, 'ENOENT')) {
         this.create(path)
-        ino = this.resolvePathToInode(path)
+        ino = this.resolvePathToInode(path, follow)
       } else {
         throw e
       }
@@ -215,19 +720,24 @@ export class Fs extends RpcTarget {
     const deviceSize = this.getDeviceSize()
     const spaceUsed = this.getSpaceUsed()
     // Estimate new space needed: sum of new data written beyond current file size
-    const fileCursor = this.ctx.storage.sql.exec('SELECT attr FROM dofs_files WHERE ino = ?', ino)
-    const fileRow = fileCursor.next().value
-    let fileSize = 0
-    if (fileRow && fileRow.attr) {
-      const attr = typeof fileRow.attr === 'string' ? JSON.parse(fileRow.attr) : fileRow.attr
-      fileSize = attr.size || 0
-    }
+    const attr = this.readAttr(ino)
+    if (attr.kind === 'Directory') throw new FsError('EISDIR')
+    if (isSpecial(attr.kind)) throw new FsError('ENXIO')
+    if (attr.kind === 'Symlink') throw new FsError('ELOOP')
+    this.checkAccess(attr, W_OK)
+    const fileSize = attr.size || 0
     const endOffset = offset + buf.length
     const additional = endOffset > fileSize ? endOffset - fileSize : 0
     if (spaceUsed + additional > deviceSize) {
-      throw Object.assign(new Error('ENOSPC'), { code: 'ENOSPC' })
+      throw new FsError('ENOSPC')
     }
     const CHUNK_SIZE = this.chunkSize
+    // Chunks at either end may be partly overwritten, so if they're in R2 they're brought back first
+    const recalling = this.recallChunks(ino, [
+      Math.floor(offset / CHUNK_SIZE) * CHUNK_SIZE,
+      Math.floor(Math.max(endOffset - 1, offset) / CHUNK_SIZE) * CHUNK_SIZE,
+    ])
+    if (recalling) return recalling.then(() => this.writeData(path, data, options))
     let written = 0
     let maxEnd = 0
     while (written < buf.length) {
@@ -237,358 +747,957 @@ export class Fs extends RpcTarget {
       const chunkOffInChunk = absOffset % CHUNK_SIZE
       const writeLen = Math.min(CHUNK_SIZE - chunkOffInChunk, buf.length - written)
       // Use helper to load chunk
-      let chunkData = this.loadChunk(ino, chunkOffset, CHUNK_SIZE)
+      const { data: chunkData, length: existingLength } = this.loadChunk(ino, chunkOffset, CHUNK_SIZE)
       chunkData.set(buf.subarray(written, written + writeLen), chunkOffInChunk)
       // Calculate chunk length (last chunk may be partial)
-      let chunkLength = CHUNK_SIZE
-      const thisEnd = chunkOffInChunk + writeLen
-      if (thisEnd < CHUNK_SIZE) {
-        chunkLength = thisEnd
-      }
+      const chunkLength = Math.max(existingLength, chunkOffInChunk + writeLen)
       // Upsert chunk
-      this.ctx.storage.sql.exec(
-        'INSERT INTO dofs_chunks (ino, offset, data, length) VALUES (?, ?, ?, ?) ON CONFLICT(ino, offset) DO UPDATE SET data=excluded.data, length=excluded.length',
+      this.sql.exec(
+        `INSERT INTO ${this.tables.chunks} (ino, offset, data, length, checksum) VALUES (?, ?, ?, ?, ?) ON CONFLICT(ino, offset) DO UPDATE SET data=excluded.data, length=excluded.length, checksum=excluded.checksum, location=NULL`,
         ino,
         chunkOffset,
         chunkData.subarray(0, chunkLength),
-        chunkLength
+        chunkLength,
+        this.checksum(chunkData.subarray(0, chunkLength))
       )
       written += writeLen
       maxEnd = Math.max(maxEnd, absOffset + writeLen)
     }
+    this.metrics.bytesWritten += buf.length
     // Update file size and space used
     this.updateFileSizeAndSpaceUsed(ino)
+    const now = Date.now()
+    this.touch(ino, { mtime: now, ctime: now })
+    if (!this.deferredReindex.has(ino)) this.reindex(ino)
   }
 
   public mkdir(path: string, options?: MkdirOptions) {
-    const parts = path.split('/').filter(Boolean)
-    if (parts.length === 0) throw Object.assign(new Error('EEXIST'), { code: 'EEXIST' })
-    const name = parts[parts.length - 1]
-    const parentPath = '/' + parts.slice(0, -1).join('/')
-    let parent: number
-    try {
-      parent = this.resolvePathToInode(parentPath)
-    } catch (e: any) {
-      if (e.message === 'ENOENT' && options?.recursive) {
-        this.mkdir(parentPath, options)
+    return this.run('mkdir', path, () => {
+      const { parts, name, parent: parentPath } = this.splitPath(path)
+      if (name === undefined) {
+        if (!options?.recursive) throw new FsError('EEXIST')
+        // Like mkdir -p, a trailing '..' still makes the directory before it
+        if (parts.length > 0) this.mkdir(parentPath, options)
+        return
+      }
+      let parent: number
+      try {
         parent = this.resolvePathToInode(parentPath)
-      } else {
-        throw e
+      } catch (e) {
+        if (isFsError(e, 'ENOENT') && options?.recursive) {
+          this.mkdir(parentPath, options)
+          parent = this.resolvePathToInode(parentPath)
+        } else {
+          throw e
+        }
       }
-    }
-    const cursor = this.ctx.storage.sql.exec('SELECT ino FROM dofs_files WHERE parent = ? AND name = ?', parent, name)
-    if (cursor.next().value) {
-      if (options?.recursive) return
-      throw Object.assign(new Error('EEXIST'), { code: 'EEXIST' })
-    }
-    const ino = this.allocInode()
-    const now = Date.now()
-    const mode = options?.mode ?? 0o755
-    const umask = options?.umask ?? 0
-    const perm = mode & ~umask & 0o7777
-    const attr = {
-      ino,
-      size: 0,
-      blocks: 0,
-      atime: now,
-      mtime: now,
-      ctime: now,
-      crtime: now,
-      kind: 'Directory',
-      perm,
-      nlink: 2,
-      uid: 0,
-      gid: 0,
-      rdev: 0,
-      flags: 0,
-      blksize: 512,
-    }
-    this.ctx.storage.sql.exec(
-      'INSERT INTO dofs_files (ino, name, parent, is_dir, attr, data) VALUES (?, ?, ?, ?, ?, NULL)',
-      ino,
-      name,
-      parent,
-      1,
-      JSON.stringify(attr)
-    )
+      if (this.findChild(parent, name)) {
+        if (options?.recursive) return
+        throw new FsError('EEXIST')
+      }
+      const parentAttr = this.readAttr(parent)
+      this.checkAccess(parentAttr, W_OK | X_OK)
+      const { ino, generation } = this.allocInode()
+      const now = Date.now()
+      const mode = options?.mode ?? 0o755
+      const umask = options?.umask ?? 0
+      // Directories inherit the setgid bit so the group propagates down the tree
+      const perm = (mode & ~umask & 0o7777) | (parentAttr.perm & S_ISGID)
+      const { uid, gid } = this.newOwner(parentAttr)
+      const attr = {
+        ino,
+        generation,
+        size: 0,
+        blocks: 0,
+        atime: now,
+        mtime: now,
+        ctime: now,
+        crtime: now,
+        kind: 'Directory',
+        perm,
+        nlink: 2,
+        uid,
+        gid,
+        rdev: 0,
+        flags: 0,
+        blksize: 512,
+      }
+      this.sql.exec(
+        `INSERT INTO ${this.tables.files} (ino, name, parent, is_dir, attr, data) VALUES (?, ?, ?, ?, ?, NULL)`,
+        ino,
+        name,
+        parent,
+        1,
+        JSON.stringify(attr)
+      )
+      this.touchDir(parent, 1)
+    })
   }
 
   public rmdir(path: string, options?: RmdirOptions) {
-    let ino: number
-    try {
-      ino = this.resolvePathToInode(path)
-    } catch (e: any) {
-      if (e.message === 'ENOENT' && options?.recursive) return
-      throw e
-    }
-    if (options?.recursive) {
-      const cursor = this.ctx.storage.sql.exec('SELECT name, is_dir FROM dofs_files WHERE parent = ?', ino)
-      for (let row of cursor) {
-        const childPath = path === '/' ? `/${row.name}` : `${path}/${row.name}`
-        if (row.is_dir) {
-          this.rmdir(childPath, options)
-        } else {
-          this.unlink(childPath)
+    return this.run('rmdir', path, () => {
+      let ino: number
+      try {
+        ino = this.resolvePathToInode(path, false)
+      } catch (e) {
+        if (isFsError(e, 'ENOENT') && options?.recursive) return
+        throw e
+      }
+      if (this.readAttr(ino).kind !== 'Directory') throw new FsError('ENOTDIR')
+      // As on Linux, a directory can't be removed through its '..'
+      if (this.parsePath(path).at(-1) === '..') throw new FsError('ENOTEMPTY')
+      const parent = this.checkRemove(ino)
+      const trash = this.useTrash(options?.permanent)
+      if (options?.recursive && trash) {
+        // The subtree moves to the trash as one entry, so only check that it could be removed
+        this.checkRemoveTree(ino)
+      } else if (options?.recursive) {
+        const cursor = this.sql.exec(`SELECT name, is_dir FROM ${this.tables.files} WHERE parent = ?`, ino)
+        for (let row of cursor) {
+          const childPath = path === '/' ? `/${row.name}` : `${path}/${row.name}`
+          if (row.is_dir) {
+            this.rmdir(childPath, options)
+          } else {
+            this.unlink(childPath, options)
+          }
         }
+      } else {
+        const cursor = this.sql.exec(`SELECT COUNT(*) as count FROM ${this.tables.files} WHERE parent = ?`, ino)
+        const row = cursor.next().value
+        if (!row) throw new FsError('ENOENT')
+        if (Number(row.count) > 0) throw new FsError('ENOTEMPTY')
       }
-    } else {
-      const cursor = this.ctx.storage.sql.exec('SELECT COUNT(*) as count FROM dofs_files WHERE parent = ?', ino)
-      const row = cursor.next().value
-      if (!row) throw new Error('ENOENT')
-      if (Number(row.count) > 0) throw new Error('ENOTEMPTY')
-    }
-    this.ctx.storage.sql.exec('DELETE FROM dofs_files WHERE ino = ?', ino)
+      if (trash) {
+        this.moveToTrash(ino)
+      } else {
+        this.sql.exec(`DELETE FROM ${this.tables.files} WHERE ino = ?`, ino)
+      }
+      this.touchDir(parent, -1)
+    })
   }
 
   public listDir(path: string, options?: ListDirOptions) {
-    const ino = this.resolvePathToInode(path)
-    const cursor = this.ctx.storage.sql.exec('SELECT name, is_dir FROM dofs_files WHERE parent = ?', ino)
-    const names: string[] = ['.', '..']
-    for (let row of cursor) {
-      if (typeof row.name === 'string') {
-        names.push(row.name)
-        if (options?.recursive && row.is_dir) {
-          const childPath = path === '/' ? `/${row.name}` : `${path}/${row.name}`
-          const childNames = this.listDir(childPath, options)
-          for (const childName of childNames) {
-            if (childName !== '.' && childName !== '..') {
-              names.push(`${row.name}/${childName}`)
+    return this.run('listDir', path, () => {
+      const ino = this.resolvePathToInode(path)
+      const attr = this.readAttr(ino)
+      if (attr.kind !== 'Directory') throw new FsError('ENOTDIR')
+      this.checkAccess(attr, R_OK)
+      this.touchAtime(ino, attr)
+      const cursor = this.sql.exec(`SELECT name, is_dir FROM ${this.tables.files} WHERE parent = ?`, ino)
+      const names: string[] = ['.', '..']
+      for (let row of cursor) {
+        if (typeof row.name === 'string') {
+          names.push(row.name)
+          if (options?.recursive && row.is_dir) {
+            const childPath = path === '/' ? `/${row.name}` : `${path}/${row.name}`
+            const childNames = this.listDir(childPath, options)
+            for (const childName of childNames) {
+              if (childName !== '.' && childName !== '..') {
+                names.push(`${row.name}/${childName}`)
+              }
             }
           }
         }
       }
-    }
-    return names
+      return names
+    })
+  }
+
+  public readdir(path: string, options?: ReaddirOptions): ReaddirResult {
+    return this.run('readdir', path, () => {
+      const ino = this.resolvePathToInode(path)
+      const attr = this.readAttr(ino)
+      if (attr.kind !== 'Directory') throw new FsError('ENOTDIR')
+      this.checkAccess(attr, R_OK)
+      this.touchAtime(ino, attr)
+      const sort = options?.sort ?? 'name'
+      if (!Object.hasOwn(sortKeys, sort)) throw new FsError('EINVAL')
+      const limit = options?.limit ?? DEFAULT_PAGE_SIZE
+      // Keyset pagination on (sort key, name), which is unique within a directory
+      const key = sortKeys[sort]
+      let after: [SqlStorageValue, string] | undefined
+      if (options?.cursor) {
+        const cursor = this.readCursor<{ sort: ReaddirSort; after: [SqlStorageValue, string] }>(options.cursor)
+        if (cursor.sort !== sort) throw new FsError('EINVAL')
+        after = cursor.after
+      }
+      const columns = options?.withStats ? 'ino, name, is_dir, attr' : "ino, name, json_extract(attr, '$.kind') AS kind"
+      const rows = this.sql
+        .exec(
+          `SELECT ${columns}, ${key} AS sort_key FROM ${this.tables.files}
+          WHERE parent = ? ${after ? `AND (${key}, name) > (?, ?)` : ''}
+          ORDER BY ${key}, name LIMIT ?`,
+          ino,
+          ...(after ?? []),
+          limit
+        )
+        .toArray()
+      const entries = rows.map((row): DirEntry => {
+        if (!options?.withStats) return { name: String(row.name), ino: Number(row.ino), kind: String(row.kind) }
+        const stat = this.toStat(Number(row.ino), !!row.is_dir, this.parseAttr(row.attr))
+        return { name: String(row.name), ino: Number(row.ino), kind: stat.kind!, stat }
+      })
+      if (rows.length < limit) return { entries }
+      const last = rows[rows.length - 1]
+      return { entries, cursor: encodeCursor({ sort, after: [last.sort_key, last.name] }) }
+    })
   }
 
   public stat(path: string): Stat {
-    const ino = this.resolvePathToInode(path)
-    const cursor = this.ctx.storage.sql.exec('SELECT attr, is_dir FROM dofs_files WHERE ino = ?', ino)
-    const row = cursor.next().value
-    if (!row) throw new Error('ENOENT')
-    const attr = typeof row.attr === 'string' ? JSON.parse(row.attr) : row.attr
-    return {
-      isFile: !row.is_dir,
-      isDirectory: !!row.is_dir,
-      size: attr.size,
-      mode: attr.perm,
-      uid: attr.uid,
-      gid: attr.gid,
-      mtime: attr.mtime,
-      ctime: attr.ctime,
-      atime: attr.atime,
-      crtime: attr.crtime,
-      blocks: attr.blocks,
-      nlink: attr.nlink,
-      rdev: attr.rdev,
-      flags: attr.flags,
-      blksize: attr.blksize,
-      kind: attr.kind,
-    }
+    return this.run('stat', path, () => {
+      const ino = this.resolvePathToInode(path)
+      const cursor = this.sql.exec(`SELECT attr, is_dir FROM ${this.tables.files} WHERE ino = ?`, ino)
+      const row = cursor.next().value
+      if (!row) throw new FsError('ENOENT')
+      return this.toStat(ino, !!row.is_dir, this.parseAttr(row.attr))
+    })
   }
 
-  public setattr(path: string, options: SetAttrOptions) {
-    const ino = this.resolvePathToInode(path)
-    const cursor = this.ctx.storage.sql.exec('SELECT attr FROM dofs_files WHERE ino = ?', ino)
-    const row = cursor.next().value
-    if (!row) throw new Error('ENOENT')
-    const attr = typeof row.attr === 'string' ? JSON.parse(row.attr) : row.attr
-    if (options.mode !== undefined) attr.perm = options.mode
-    if (options.uid !== undefined) attr.uid = options.uid
-    if (options.gid !== undefined) attr.gid = options.gid
-    this.ctx.storage.sql.exec('UPDATE dofs_files SET attr = ? WHERE ino = ?', JSON.stringify(attr), ino)
+  // Like stat, but describes a symlink itself rather than what it points to
+  public lstat(path: string): Stat {
+    return this.run('lstat', path, () => {
+      const ino = this.resolvePathToInode(path, false)
+      const cursor = this.sql.exec(`SELECT attr, is_dir FROM ${this.tables.files} WHERE ino = ?`, ino)
+      const row = cursor.next().value
+      if (!row) throw new FsError('ENOENT')
+      return this.toStat(ino, !!row.is_dir, this.parseAttr(row.attr))
+    })
   }
 
-  public symlink(target: string, path: string) {
-    const parts = path.split('/').filter(Boolean)
-    if (parts.length === 0) throw new Error('EEXIST')
-    const name = parts[parts.length - 1]
-    const parentPath = '/' + parts.slice(0, -1).join('/')
-    const parent = this.resolvePathToInode(parentPath)
-    // Check if already exists
-    const cursor = this.ctx.storage.sql.exec('SELECT ino FROM dofs_files WHERE parent = ? AND name = ?', parent, name)
-    if (cursor.next().value) throw new Error('EEXIST')
-    const ino = this.allocInode()
-    const now = Date.now()
-    const attr = {
-      ino,
-      size: target.length,
-      blocks: 0,
-      atime: now,
-      mtime: now,
-      ctime: now,
-      crtime: now,
-      kind: 'Symlink',
-      perm: 0o777,
-      nlink: 1,
-      uid: 0,
-      gid: 0,
-      rdev: 0,
-      flags: 0,
-      blksize: 512,
-    }
-    const data = new TextEncoder().encode(target)
-    this.ctx.storage.sql.exec(
-      'INSERT INTO dofs_files (ino, name, parent, is_dir, attr, data) VALUES (?, ?, ?, ?, ?, ?)',
-      ino,
-      name,
-      parent,
-      0,
-      JSON.stringify(attr),
-      data
-    )
+  // Canonical absolute path, with every symlink, '.' and '..' resolved
+  public realpath(path: string) {
+    return this.run('realpath', path, () => {
+      const resolved = this.pathOfInode(this.resolvePathToInode(path))
+      if (resolved === undefined) throw new FsError('ENOENT')
+      return resolved
+    })
   }
 
-  public readlink(path: string) {
-    const ino = this.resolvePathToInode(path)
-    const cursor = this.ctx.storage.sql.exec('SELECT data FROM dofs_files WHERE ino = ?', ino)
-    const row = cursor.next().value
-    if (!row || !row.data) throw new Error('ENOENT')
-    let arr: Uint8Array
-    if (row.data instanceof ArrayBuffer) {
-      arr = new Uint8Array(row.data)
-    } else if (ArrayBuffer.isView(row.data)) {
-      arr = new Uint8Array(row.data.buffer)
-    } else {
-      throw new Error('ENOENT')
-    }
-    return new TextDecoder().decode(arr)
-  }
-
-  public rename(oldPath: string, newPath: string) {
-    const oldParts = oldPath.split('/').filter(Boolean)
-    const newParts = newPath.split('/').filter(Boolean)
-    if (oldParts.length === 0 || newParts.length === 0) throw Object.assign(new Error('ENOENT'), { code: 'ENOENT' })
-    const oldName = oldParts[oldParts.length - 1]
-    const oldParentPath = '/' + oldParts.slice(0, -1).join('/')
-    const newName = newParts[newParts.length - 1]
-    const newParentPath = '/' + newParts.slice(0, -1).join('/')
-    const oldParent = this.resolvePathToInode(oldParentPath)
-    const newParent = this.resolvePathToInode(newParentPath)
-    const oldCursor = this.ctx.storage.sql.exec(
-      'SELECT ino FROM dofs_files WHERE parent = ? AND name = ?',
-      oldParent,
-      oldName
-    )
-    const oldRow = oldCursor.next().value
-    if (!oldRow) throw Object.assign(new Error('ENOENT'), { code: 'ENOENT' })
-    const ino = oldRow.ino
-    // If destination exists, check if it's a non-empty directory
-    const newCursor = this.ctx.storage.sql.exec(
-      'SELECT ino, is_dir FROM dofs_files WHERE parent = ? AND name = ?',
-      newParent,
-      newName
-    )
-    const newRow = newCursor.next().value
-    if (newRow) {
-      if (newRow.is_dir) {
-        const childCursor = this.ctx.storage.sql.exec(
-          'SELECT COUNT(*) as count FROM dofs_files WHERE parent = ?',
-          newRow.ino
-        )
-        const childRow = childCursor.next().value
-        if (childRow && Number(childRow.count) > 0) throw Object.assign(new Error('ENOTEMPTY'), { code: 'ENOTEMPTY' })
-      }
-      this.ctx.storage.sql.exec('DELETE FROM dofs_files WHERE ino = ?', newRow.ino)
-      this.ctx.storage.sql.exec('DELETE FROM dofs_chunks WHERE ino = ?', newRow.ino)
-    }
-    this.ctx.storage.sql.exec('UPDATE dofs_files SET parent = ?, name = ? WHERE ino = ?', newParent, newName, ino)
+  // Inode-based access for clients that hold inode numbers rather than paths, like a FUSE mount. Given the
+  // generation from an earlier stat, these fail with ESTALE once that file is gone or the number was reused.
+  public statInode(ino: number, generation?: number): Stat {
+    return this.run('statInode', `#${ino}`, () => {
+      const { isDir, attr } = this.readInode(ino, generation)
+      return this.toStat(ino, isDir, attr)
+    })
   }
 
-  public unlink(path: string) {
-    const ino = this.resolvePathToInode(path)
-    const cursor = this.ctx.storage.sql.exec('SELECT is_dir FROM dofs_files WHERE ino = ?', ino)
-    const row = cursor.next().value
-    if (!row) throw Object.assign(new Error('ENOENT'), { code: 'ENOENT' })
-    if (row.is_dir) throw Object.assign(new Error('EISDIR'), { code: 'EISDIR' })
-    this.ctx.storage.sql.exec('DELETE FROM dofs_files WHERE ino = ?', ino)
-    this.ctx.storage.sql.exec('DELETE FROM dofs_chunks WHERE ino = ?', ino)
-    // Update space used
-    this.updateFileSizeAndSpaceUsed(ino)
+  // Stat the entry called name in the directory with inode parent, like FUSE's lookup
+  public lookup(parent: number, name: string, generation?: number): Stat {
+    return this.run('lookup', name, () => {
+      const { attr: parentAttr } = this.readInode(parent, generation)
+      if (parentAttr.kind !== 'Directory') throw new FsError('ENOTDIR')
+      this.checkAccess(parentAttr, X_OK)
+      if (name === '.' || name === '..') throw new FsError('EINVAL')
+      const row = this.findChild(parent, validateName(name, this.options.paths))
+      if (!row) throw new FsError('ENOENT')
+      return this.toStat(Number(row.ino), !!row.is_dir, this.parseAttr(row.attr))
+    })
   }
 
-  public create(path: string, options?: CreateOptions) {
-    const parts = path.split('/').filter(Boolean)
-    if (parts.length === 0) throw Object.assign(new Error('EEXIST'), { code: 'EEXIST' })
-    const name = parts[parts.length - 1]
-    const parentPath = '/' + parts.slice(0, -1).join('/')
-    const parent = this.resolvePathToInode(parentPath)
-    // Check if already exists
-    const cursor = this.ctx.storage.sql.exec('SELECT ino FROM dofs_files WHERE parent = ? AND name = ?', parent, name)
-    if (cursor.next().value) throw Object.assign(new Error('EEXIST'), { code: 'EEXIST' })
-    const ino = this.allocInode()
-    const now = Date.now()
-    const mode = options?.mode ?? 0o644
-    const umask = options?.umask ?? 0
-    const perm = mode & ~umask & 0o7777
-    const attr = {
-      ino,
-      size: 0,
-      blocks: 0,
-      atime: now,
-      mtime: now,
-      ctime: now,
-      crtime: now,
-      kind: 'File',
-      perm,
-      nlink: 1,
-      uid: 0,
-      gid: 0,
-      rdev: 0,
-      flags: 0,
-      blksize: 512,
-    }
-    this.ctx.storage.sql.exec(
-      'INSERT INTO dofs_files (ino, name, parent, is_dir, attr, data) VALUES (?, ?, ?, ?, ?, NULL)',
-      ino,
-      name,
-      parent,
-      0,
-      JSON.stringify(attr)
-    )
+  // The current path of an inode, which follows it through renames
+  public pathOf(ino: number, generation?: number): string {
+    return this.run('pathOf', `#${ino}`, () => {
+      this.readInode(ino, generation)
+      const path = this.pathOfInode(ino)
+      if (path === undefined) throw new FsError('ENOENT')
+      return path
+    })
   }
 
-  public truncate(path: string, size: number) {
-    const ino = this.resolvePathToInode(path)
+  public find(root: string, options?: FindOptions): FindResult {
+    return this.run('find', root, () => {
+      const ino = this.resolvePathToInode(root)
+      const attr = this.readAttr(ino)
+      if (attr.kind !== 'Directory') throw new FsError('ENOTDIR')
+      this.checkAccess(attr, R_OK | X_OK)
+      return this.queryTree(ino, root, options ?? {})
+    })
+  }
+
+  // Totals per subtree, in path order. Bytes are stored chunk lengths, matching space_used
+  public du(path: string, options?: DuOptions): DuEntry[] {
+    return this.run('du', path, () => {
+      const ino = this.resolvePathToInode(path)
+      const attr = this.readAttr(ino)
+      if (attr.kind === 'Directory') this.checkAccess(attr, R_OK | X_OK)
+      const base = this.parsePath(path).join('/')
+      // Every entry is counted in its nearest reported directory (its bucket), then buckets roll up into their parents
+      const rows = this.sql
+        .exec(
+          `WITH RECURSIVE tree(ino, parent, path, depth, is_dir, attr, bucket) AS (
+            SELECT ino, parent, ?, 0, is_dir, attr, ino FROM ${this.tables.files} WHERE ino = ?
+            UNION ALL
+            SELECT f.ino, f.parent, tree.path || '/' || f.name, tree.depth + 1, f.is_dir, f.attr,
+              CASE WHEN f.is_dir AND tree.depth < ? THEN f.ino ELSE tree.bucket END
+            FROM ${this.tables.files} f JOIN tree ON f.parent = tree.ino
+            WHERE tree.is_dir AND ${this.searchableSql('tree.attr')}
+          )
+          SELECT bucket,
+            MAX(CASE WHEN ino = bucket THEN path END) AS path,
+            MAX(CASE WHEN ino = bucket THEN parent END) AS parent,
+            MAX(CASE WHEN ino = bucket THEN depth END) AS depth,
+            COUNT(*) AS inodes,
+            SUM((SELECT COALESCE(SUM(length), 0) FROM ${this.tables.chunks} c WHERE c.ino = tree.ino)) AS bytes
+          FROM tree GROUP BY bucket ORDER BY depth DESC`,
+          base ? '/' + base : '',
+          ino,
+          options?.maxDepth ?? Number.MAX_SAFE_INTEGER
+        )
+        .toArray()
+      const totals = new Map<number, DuEntry>()
+      for (const row of rows) {
+        totals.set(Number(row.bucket), { path: String(row.path) || '/', bytes: Number(row.bytes), inodes: Number(row.inodes) })
+      }
+      // Deepest first, so each directory is complete before it's added to its parent
+      for (const row of rows) {
+        const parent = row.bucket === ino ? undefined : totals.get(Number(row.parent))
+        const entry = totals.get(Number(row.bucket))!
+        if (parent) {
+          parent.bytes += entry.bytes
+          parent.inodes += entry.inodes
+        }
+      }
+      return [...totals.values()].sort((a, b) => (a.path < b.path ? -1 : a.path > b.path ? 1 : 0))
+    })
+  }
+
+  public glob(pattern: string, options?: GlobOptions): FindResult {
+    return this.run('glob', pattern, () => {
+      // Normalized like the paths it's matched against. '..' in the literal base is looked up like any path, while
+      // after a wildcard it matches nothing
+      const { base, segments } = splitGlob(normalizePath(pattern, this.options.paths))
+      if (segments.length === 0) throw new FsError('EINVAL')
+      const ino = this.resolvePathToInode(base)
+      const attr = this.readAttr(ino)
+      if (attr.kind !== 'Directory') throw new FsError('ENOTDIR')
+      this.checkAccess(attr, R_OK | X_OK)
+      // Without ** the depth is fixed, and the last segment can usually be matched by SQLite's GLOB
+      const fixedDepth = !segments.includes('**')
+      const last = segments[segments.length - 1]
+      const query: TreeQuery = {
+        ...options,
+        name: last === '**' ? undefined : toSqlGlob(last),
+        minDepth: fixedDepth ? segments.length : undefined,
+        maxDepth: fixedDepth ? segments.length : undefined,
+      }
+      const regex = globToRegExp(base, segments)
+      return this.queryTree(ino, base, query, (path) => regex.test(path))
+    })
+  }
+
+  public search(query: string, options?: SearchOptions): SearchResult[] {
+    return this.run('search', options?.path ?? '/', () => {
+      if (!this.options.indexText) throw new FsError('ENOTSUP')
+      const root = this.resolvePathToInode(options?.path ?? '/')
+      const [open, close] = options?.highlight ?? ['<mark>', '</mark>']
+      const limit = options?.limit ?? 50
+      const results: SearchResult[] = []
+      // Matches the caller can't read are dropped before they count toward the limit, so keep fetching pages of
+      // matches until it's reached or they run out
+      for (let offset = 0; results.length < limit; offset += limit) {
+        let rows: Record<string, SqlStorageValue>[]
+        try {
+          rows = this.sql
+            .exec(
+              `WITH RECURSIVE tree(ino) AS (
+                SELECT ? UNION ALL SELECT f.ino FROM ${this.tables.files} f JOIN tree ON f.parent = tree.ino
+              )
+              SELECT rowid AS ino, snippet(${this.tables.text}, 0, ?, ?, '…', 16) AS snippet, rank FROM ${this.tables.text}
+              WHERE ${this.tables.text} MATCH ? AND rowid IN (SELECT ino FROM tree)
+              ORDER BY rank, rowid LIMIT ? OFFSET ?`,
+              root,
+              open,
+              close,
+              query,
+              limit,
+              offset
+            )
+            .toArray()
+        } catch {
+          // FTS5 rejects malformed queries
+          throw new FsError('EINVAL')
+        }
+        for (const row of rows) {
+          if (results.length === limit) break
+          const path = this.pathOfInode(Number(row.ino))
+          if (!path) continue
+          try {
+            this.checkAccess(this.readAttr(this.resolvePathToInode(path)), R_OK)
+          } catch (e) {
+            if (isFsError(e, 'EACCES')) continue
+            throw e
+          }
+          results.push({ path, snippet: String(row.snippet), rank: Number(row.rank) })
+        }
+        if (rows.length < limit) break
+      }
+      return results
+    })
+  }
+
+  // Re-index every text file, e.g. after turning on indexText for an existing filesystem
+  public rebuildTextIndex() {
+    return this.run('rebuildTextIndex', '/', () => {
+      if (!this.options.indexText) throw new FsError('ENOTSUP')
+      // Reads every file regardless of permissions, so only root can start it
+      if (this.credentials.uid !== 0) throw new FsError('EPERM')
+      this.sql.exec(`DELETE FROM ${this.tables.text}`)
+      const cursor = this.sql.exec(`SELECT ino FROM ${this.tables.files} WHERE json_extract(attr, '$.kind') = 'File'`)
+      for (const row of cursor.toArray()) this.updateTextIndex(Number(row.ino))
+    })
+  }
+
+  public access(path: string, mode: number = F_OK) {
+    return this.run('access', path, () => {
+      const ino = this.resolvePathToInode(path)
+      if (mode === F_OK) return
+      this.checkAccess(this.readAttr(ino), mode & (R_OK | W_OK | X_OK))
+    })
+  }
+
+  public setattr(path: string, options: SetAttrOptions) {
+    return this.run('setattr', path, () => {
+      const ino = this.resolvePathToInode(path, options.followSymlinks ?? true)
+      const attr = this.readAttr(ino)
+      const { uid, gid, groups } = this.credentials
+      const isRoot = uid === 0
+      const isOwner = isRoot || attr.uid === uid
+      const inGroup = (g: number) => g === gid || !!groups?.includes(g)
+      // Only root may give a file away; the owner may only change the group to one they belong to
+      if (options.uid !== undefined && options.uid !== attr.uid && !isRoot) {
+        throw new FsError('EPERM')
+      }
+      if (options.gid !== undefined && options.gid !== attr.gid && !(isRoot || (isOwner && inGroup(options.gid)))) {
+        throw new FsError('EPERM')
+      }
+      if (options.mode !== undefined && !isOwner) {
+        throw new FsError('EPERM')
+      }
+      if (options.uid !== undefined) attr.uid = options.uid
+      if (options.gid !== undefined) attr.gid = options.gid
+      if (options.mode !== undefined) {
+        attr.perm = options.mode & 0o7777
+        // Non-members of the file's group cannot set the setgid bit
+        if (!isRoot && !inGroup(attr.gid)) attr.perm &= ~S_ISGID
+      }
+      attr.ctime = Date.now()
+      this.sql.exec(`UPDATE ${this.tables.files} SET attr = ? WHERE ino = ?`, JSON.stringify(attr), ino)
+    })
+  }
+
+  public utimes(path: string, atime: number | Date, mtime: number | Date, options?: FollowOptions) {
+    return this.run('utimes', path, () => {
+      const ino = this.resolvePathToInode(path, options?.followSymlinks ?? true)
+      const attr = this.readAttr(ino)
+      const { uid } = this.credentials
+      if (uid !== 0 && attr.uid !== uid) throw new FsError('EPERM')
+      this.touch(ino, { atime: Number(atime), mtime: Number(mtime), ctime: Date.now() })
+    })
+  }
+
+  // Delete an entry (recursively, for a directory) at the given time, or clear its expiry with null
+  public setExpiry(path: string, at: number | Date | null, options?: FollowOptions) {
+    return this.run('setExpiry', path, () => {
+      const ino = this.resolvePathToInode(path, options?.followSymlinks ?? true)
+      const attr = this.readAttr(ino)
+      const { uid } = this.credentials
+      if (uid !== 0 && attr.uid !== uid) throw new FsError('EPERM')
+      if (at === null) {
+        this.clearExpiry(ino)
+      } else {
+        this.sql.exec(
+          `UPDATE ${this.tables.files} SET attr = json_set(attr, '$.expiresAt', ?) WHERE ino = ?`,
+          Number(at),
+          ino
+        )
+        this.scheduleAlarm(Number(at))
+      }
+      this.touch(ino, { ctime: Date.now() })
+    })
+  }
+
+  public symlink(target: string, path: string) {
+    return this.run('symlink', target, path, () => {
+      validateTarget(target)
+      const { name, parent: parentPath } = this.splitPath(path)
+      if (name === undefined) throw new FsError('EEXIST')
+      const parent = this.resolvePathToInode(parentPath)
+      // Check if already exists
+      if (this.findChild(parent, name)) throw new FsError('EEXIST')
+      const parentAttr = this.readAttr(parent)
+      this.checkAccess(parentAttr, W_OK | X_OK)
+      const { ino, generation } = this.allocInode()
+      const now = Date.now()
+      const { uid, gid } = this.newOwner(parentAttr)
+      const attr = {
+        ino,
+        generation,
+        size: target.length,
+        blocks: 0,
+        atime: now,
+        mtime: now,
+        ctime: now,
+        crtime: now,
+        kind: 'Symlink',
+        perm: 0o777,
+        nlink: 1,
+        uid,
+        gid,
+        rdev: 0,
+        flags: 0,
+        blksize: 512,
+      }
+      const data = new TextEncoder().encode(target)
+      this.sql.exec(
+        `INSERT INTO ${this.tables.files} (ino, name, parent, is_dir, attr, data) VALUES (?, ?, ?, ?, ?, ?)`,
+        ino,
+        name,
+        parent,
+        0,
+        JSON.stringify(attr),
+        data
+      )
+      this.touchDir(parent)
+    })
+  }
+
+  public readlink(path: string) {
+    return this.run('readlink', path, () => {
+      const ino = this.resolvePathToInode(path, false)
+      const cursor = this.sql.exec(`SELECT data, attr FROM ${this.tables.files} WHERE ino = ?`, ino)
+      const row = cursor.next().value
+      if (!row) throw new FsError('ENOENT')
+      const attr = this.parseAttr(row.attr)
+      if (attr.kind !== 'Symlink') throw new FsError('EINVAL')
+      this.touchAtime(ino, attr)
+      let arr: Uint8Array
+      if (row.data instanceof ArrayBuffer) {
+        arr = new Uint8Array(row.data)
+      } else if (ArrayBuffer.isView(row.data)) {
+        arr = new Uint8Array(row.data.buffer)
+      } else {
+        throw new FsError('ENOENT')
+      }
+      return new TextDecoder().decode(arr)
+    })
+  }
+
+  public rename(oldPath: string, newPath: string, options?: RenameOptions) {
+    return this.run('rename', oldPath, newPath, () => {
+      if (options?.noReplace && options?.exchange) throw new FsError('EINVAL')
+      const { name: oldLookup, parent: oldParentPath } = this.splitPath(oldPath)
+      const { name: newName, parent: newParentPath } = this.splitPath(newPath)
+      if (oldLookup === undefined || newName === undefined) throw new FsError('ENOENT')
+      const oldParent = this.resolvePathToInode(oldParentPath)
+      const newParent = this.resolvePathToInode(newParentPath)
+      const oldRow = this.findChild(oldParent, oldLookup)
+      if (!oldRow) throw new FsError('ENOENT')
+      // The stored name, which differs from the one given when lookups are case-insensitive
+      const oldName = String(oldRow.name)
+      const ino = Number(oldRow.ino)
+      this.checkRemove(ino)
+      const newParentAttr = this.readAttr(newParent)
+      this.checkAccess(newParentAttr, W_OK | X_OK)
+      // Moving a directory to a new parent rewrites its '..' entry
+      const attr = this.readAttr(ino)
+      if (newParent !== oldParent && attr.kind === 'Directory') this.checkAccess(attr, W_OK)
+      // A directory can't be moved into its own subtree, which would detach it from the root
+      if (attr.kind === 'Directory' && this.isWithin(newParent, ino)) throw new FsError('EINVAL')
+      const newRow = this.findChild(newParent, newName)
+      // Renaming an entry onto itself does nothing, except change the case of its name when lookups ignore case
+      if (newRow && Number(newRow.ino) === ino) {
+        if (newName !== oldName) this.sql.exec(`UPDATE ${this.tables.files} SET name = ? WHERE ino = ?`, newName, ino)
+        return
+      }
+      if (options?.exchange) {
+        if (!newRow) throw new FsError('ENOENT')
+        this.exchange(ino, attr, oldParent, oldName, Number(newRow.ino), newParent, newName)
+        return
+      }
+      if (newRow) {
+        if (options?.noReplace) throw new FsError('EEXIST')
+        if (attr.kind === 'Directory' && !newRow.is_dir) throw new FsError('ENOTDIR')
+        if (attr.kind !== 'Directory' && newRow.is_dir) throw new FsError('EISDIR')
+        this.checkRemove(Number(newRow.ino))
+        if (newRow.is_dir) {
+          const childCursor = this.sql.exec(
+            `SELECT COUNT(*) as count FROM ${this.tables.files} WHERE parent = ?`,
+            newRow.ino
+          )
+          const childRow = childCursor.next().value
+          if (childRow && Number(childRow.count) > 0) throw new FsError('ENOTEMPTY')
+        }
+        const replacedAttr = this.readAttr(Number(newRow.ino))
+        if (this.versioning() && attr.kind === 'File' && replacedAttr.kind === 'File') {
+          // The replaced file's content and history carry over to the file now at its path
+          if (replacedAttr.size > 0) this.snapshotVersion(Number(newRow.ino), replacedAttr, true)
+          this.sql.exec(`UPDATE ${this.tables.versions} SET ino = ? WHERE ino = ?`, ino, newRow.ino)
+          this.pruneVersions(ino)
+        }
+        this.removeInode(Number(newRow.ino))
+        this.updateSpaceUsed()
+      }
+      this.sql.exec(`UPDATE ${this.tables.files} SET parent = ?, name = ? WHERE ino = ?`, newParent, newName, ino)
+      // A moved directory's '..' link moves with it; a replaced directory drops its link
+      const movedDir = attr.kind === 'Directory' && newParent !== oldParent ? 1 : 0
+      const replacedDir = newRow?.is_dir ? 1 : 0
+      this.touchDir(newParent, movedDir - replacedDir)
+      if (newParent !== oldParent) this.touchDir(oldParent, -movedDir)
+      this.touch(ino, { ctime: Date.now() })
+    })
+  }
+
+  public copyFile(src: string, dest: string, options?: CopyFileOptions) {
+    return this.run('copyFile', src, dest, () => {
+      const ino = this.resolvePathToInode(src)
+      const attr = this.readAttr(ino)
+      if (attr.kind === 'Directory') throw new FsError('EISDIR')
+      if (isSpecial(attr.kind)) throw new FsError('ENXIO')
+      this.copyEntry(ino, attr, dest, { overwrite: options?.overwrite ?? true })
+    })
+  }
+
+  public cp(src: string, dest: string, options?: CpOptions) {
+    return this.run('cp', src, dest, () => {
+      // Like cp -R, a symlink given as src is copied as a link
+      const ino = this.resolvePathToInode(src, false)
+      const attr = this.readAttr(ino)
+      if (attr.kind === 'Directory') {
+        if (!options?.recursive) throw new FsError('EISDIR')
+        // Compared by inode, since symlinks and '..' can reach the same directory by different paths
+        if (this.isWithin(this.resolvePathToInode(this.splitPath(dest).parent), ino)) throw new FsError('EINVAL')
+        // Fail before copying anything rather than leaving a partial tree behind
+        const [{ bytes }] = this.du(src, { maxDepth: 0 })
+        if (this.getSpaceUsed() + bytes > this.getDeviceSize()) throw new FsError('ENOSPC')
+      }
+      this.copyEntry(ino, attr, dest, { ...options, overwrite: options?.overwrite ?? true })
+    })
+  }
+
+  public unlink(path: string, options?: UnlinkOptions) {
+    return this.run('unlink', path, () => {
+      const ino = this.resolvePathToInode(path, false)
+      const cursor = this.sql.exec(`SELECT is_dir FROM ${this.tables.files} WHERE ino = ?`, ino)
+      const row = cursor.next().value
+      if (!row) throw new FsError('ENOENT')
+      if (row.is_dir) throw new FsError('EISDIR')
+      const parent = this.checkRemove(ino)
+      if (this.useTrash(options?.permanent)) {
+        this.moveToTrash(ino)
+      } else {
+        this.removeInode(ino)
+        this.updateSpaceUsed()
+      }
+      this.touchDir(parent)
+    })
+  }
+
+  public create(path: string, options?: CreateOptions) {
+    return this.run('create', path, () => this.createNode(path, 'File', options))
+  }
+
+  // Create a FIFO, socket or device node (or an empty file). As with mknod(2), only root may create devices.
+  public mknod(path: string, options: MknodOptions) {
+    return this.run('mknod', path, () => {
+      const { kind } = options
+      if (kind !== 'File' && !isSpecial(kind)) throw new FsError('EINVAL')
+      const isDevice = kind === 'CharDevice' || kind === 'BlockDevice'
+      if (isDevice && this.credentials.uid !== 0) throw new FsError('EPERM')
+      this.createNode(path, kind, options, isDevice ? (options.rdev ?? 0) : 0)
+    })
+  }
+
+  public async truncate(path: string, size: number, options?: FollowOptions) {
+    await this.run('truncate', path, () => this.truncateData(path, size, options))
+  }
+
+  // truncate() without run(), which writeFile uses to empty a file without waiting
+  private truncateData(path: string, size: number, options?: FollowOptions): void | Promise<void> {
+    const ino = this.resolvePathToInode(path, options?.followSymlinks ?? true)
+    const attr = this.readAttr(ino)
+    if (attr.kind === 'Directory') throw new FsError('EISDIR')
+    if (isSpecial(attr.kind)) throw new FsError('ENXIO')
+    // Only reachable with followSymlinks: false, where a symlink fails like O_NOFOLLOW
+    if (attr.kind === 'Symlink') throw new FsError('ELOOP')
+    this.checkAccess(attr, W_OK)
+    // A chunk straddling the new size is trimmed, so if it's in R2 it's brought back first
+    if (size % this.chunkSize !== 0) {
+      const recalling = this.recallChunks(ino, [Math.floor(size / this.chunkSize) * this.chunkSize])
+      if (recalling) return recalling.then(() => this.truncateData(path, size, options))
+    }
+    if (this.versioning() && size < (attr.size || 0)) {
+      // Truncating to zero drops every chunk, so the version can take them over instead of copying
+      this.snapshotVersion(ino, attr, size === 0)
+      this.pruneVersions(ino)
+    }
     const CHUNK_SIZE = this.chunkSize
-    // Delete all chunks past the new size
-    const firstExcessChunk = Math.floor(size / CHUNK_SIZE) * CHUNK_SIZE
-    this.ctx.storage.sql.exec('DELETE FROM dofs_chunks WHERE ino = ? AND offset >= ?', ino, firstExcessChunk)
+    // Delete all chunks starting at or past the new size; a chunk straddling it is trimmed below
+    this.sql.exec(`DELETE FROM ${this.tables.chunks} WHERE ino = ? AND offset >= ?`, ino, size)
+    // Whatever is written next may be a different kind of file
+    if (size === 0) this.setContentType(ino, undefined)
     // If the last chunk is partial, trim it
     if (size % CHUNK_SIZE !== 0) {
       const lastChunkOffset = Math.floor(size / CHUNK_SIZE) * CHUNK_SIZE
       const lastLen = size % CHUNK_SIZE
       // Use helper to load chunk
-      let chunkData = this.loadChunk(ino, lastChunkOffset, CHUNK_SIZE)
-      chunkData = chunkData.subarray(0, lastLen)
-      this.ctx.storage.sql.exec(
-        'UPDATE dofs_chunks SET data = ?, length = ? WHERE ino = ? AND offset = ?',
+      const chunkData = this.loadChunk(ino, lastChunkOffset, CHUNK_SIZE).data.subarray(0, lastLen)
+      this.sql.exec(
+        `UPDATE ${this.tables.chunks} SET data = ?, length = ?, checksum = ? WHERE ino = ? AND offset = ?`,
         chunkData,
         lastLen,
+        this.checksum(chunkData),
         ino,
         lastChunkOffset
       )
     }
     // Update file size and space used
     this.updateFileSizeAndSpaceUsed(ino)
+    const now = Date.now()
+    this.touch(ino, { mtime: now, ctime: now })
+    if (!this.deferredReindex.has(ino)) this.reindex(ino)
+  }
+
+  // Recompute every chunk's checksum and the file digest, reporting chunks whose data no longer matches
+  public async verify(path: string): Promise<VerifyResult> {
+    return this.run('verify', path, () => {
+      if (!this.options.checksums) throw new FsError('ENOTSUP')
+      const ino = this.resolvePathToInode(path)
+      const attr = this.readAttr(ino)
+      if (attr.kind === 'Directory') throw new FsError('EISDIR')
+      this.checkAccess(attr, R_OK)
+      const rows = this.sql
+        .exec(`SELECT offset, data, checksum, location FROM ${this.tables.chunks} WHERE ino = ? ORDER BY offset`, ino)
+        .toArray()
+      const check = (): VerifyResult => {
+        const corruptOffsets: number[] = []
+        const checksums: string[] = []
+        for (const row of rows) {
+          const actual = this.checksum(new Uint8Array(row.data as ArrayBuffer))!
+          if (row.checksum != null && row.checksum !== actual) corruptOffsets.push(Number(row.offset))
+          checksums.push(String(row.checksum ?? actual))
+        }
+        const digest = this.checksum(new TextEncoder().encode(checksums.join('\n')))
+        // A stale digest means chunks were changed or lost without going through Fs
+        const ok = corruptOffsets.length === 0 && (attr.digest === undefined || attr.digest === digest)
+        // Files written before checksums were enabled get theirs now
+        if (ok && attr.digest === undefined) this.updateDigest(ino)
+        return { ok, digest, corruptOffsets }
+      }
+      // Chunks in R2 are fetched and checked too, which makes the result a promise
+      const tiered = rows.filter((row) => row.location != null)
+      if (tiered.length === 0) return check()
+      return Promise.all(
+        tiered.map(async (row) => {
+          row.data = await this.fetchChunk(String(row.location))
+        })
+      ).then(check)
+    })
+  }
+
+  // Previous versions of a file, newest first
+  public listVersions(path: string): FileVersion[] {
+    return this.run('listVersions', path, () => {
+      const ino = this.resolvePathToInode(path)
+      this.checkAccess(this.readAttr(ino), R_OK)
+      const rows = this.sql
+        .exec(`SELECT id, size, mtime, created_at FROM ${this.tables.versions} WHERE ino = ? ORDER BY id DESC`, ino)
+        .toArray()
+      return rows.map((row) => ({
+        version: Number(row.id),
+        size: Number(row.size),
+        mtime: Number(row.mtime),
+        createdAt: Number(row.created_at),
+      }))
+    })
+  }
+
+  // Restore a previous version's content. The current content becomes a version itself, so a revert can be undone
+  public revert(path: string, version: number) {
+    return this.run('revert', path, () => {
+      const ino = this.resolvePathToInode(path)
+      const attr = this.readAttr(ino)
+      if (attr.kind === 'Directory') throw new FsError('EISDIR')
+      this.checkAccess(attr, W_OK)
+      this.readVersion(ino, version)
+      if (this.getSpaceUsed() + this.chunkBytes(-version) > this.getDeviceSize()) throw new FsError('ENOSPC')
+      if (attr.size > 0) this.snapshotVersion(ino, attr, true)
+      this.sql.exec(`DELETE FROM ${this.tables.chunks} WHERE ino = ?`, ino)
+      this.sql.exec(
+        `INSERT INTO ${this.tables.chunks} (ino, offset, data, length, checksum, location) SELECT ?, offset, data, length, checksum, location FROM ${this.tables.chunks} WHERE ino = ?`,
+        ino,
+        -version
+      )
+      this.setContentType(ino, undefined)
+      this.pruneVersions(ino)
+      this.updateFileSizeAndSpaceUsed(ino)
+      const now = Date.now()
+      this.touch(ino, { mtime: now, ctime: now })
+      this.reindex(ino)
+    })
+  }
+
+  // Entries in the trash, newest first. Callers other than root only see what they deleted
+  public listTrash(): TrashEntry[] {
+    return this.run('listTrash', '/', () => {
+      const { uid } = this.credentials
+      const rows = this.sql
+        .exec(
+          `SELECT t.id, t.path, t.deleted_at, f.ino, f.is_dir, f.attr FROM ${this.tables.trash} t JOIN ${this.tables.files} f ON f.ino = t.ino
+          ${uid === 0 ? '' : 'WHERE t.uid = ?'} ORDER BY t.deleted_at DESC, t.id DESC`,
+          ...(uid === 0 ? [] : [uid])
+        )
+        .toArray()
+      return rows.map((row) => ({
+        id: Number(row.id),
+        path: String(row.path),
+        deletedAt: Number(row.deleted_at),
+        stat: this.toStat(Number(row.ino), !!row.is_dir, this.parseAttr(row.attr)),
+      }))
+    })
+  }
+
+  // Put a trash entry back at its original path, or at dest
+  public restore(id: number, dest?: string) {
+    // Without dest, the path is only known once the entry is found
+    let path = dest ?? '/'
+    return this.run('restore', () => path, () => {
+      const { uid } = this.credentials
+      const entry = this.sql.exec(`SELECT ino, path, uid FROM ${this.tables.trash} WHERE id = ?`, id).next().value
+      if (!entry || (uid !== 0 && Number(entry.uid) !== uid)) throw new FsError('ENOENT', 'restore')
+      path = dest ?? String(entry.path)
+      const { name, parent: parentPath } = this.splitPath(path)
+      if (name === undefined) throw new FsError('EEXIST')
+      const parent = this.resolvePathToInode(parentPath)
+      const parentAttr = this.readAttr(parent)
+      if (parentAttr.kind !== 'Directory') throw new FsError('ENOTDIR')
+      this.checkAccess(parentAttr, W_OK | X_OK)
+      if (this.findChild(parent, name)) throw new FsError('EEXIST')
+      const ino = Number(entry.ino)
+      const isDir = this.readAttr(ino).kind === 'Directory'
+      this.sql.exec(`UPDATE ${this.tables.files} SET parent = ?, name = ? WHERE ino = ?`, parent, name, ino)
+      this.sql.exec(`DELETE FROM ${this.tables.trash} WHERE id = ?`, id)
+      this.touchDir(parent, isDir ? 1 : 0)
+      this.touch(ino, { ctime: Date.now() })
+    })
+  }
+
+  // Permanently delete trash entries, returning how many were purged
+  public emptyTrash(options?: EmptyTrashOptions): number {
+    return this.run('emptyTrash', '/', () => {
+      const before = options?.olderThan === undefined ? Number.MAX_SAFE_INTEGER : Number(options.olderThan)
+      const { uid } = this.credentials
+      return this.purgeTrash(before, uid === 0 ? undefined : uid)
+    })
+  }
+
+  // Check the schema's invariants, optionally repairing what's broken. Root only
+  public fsck(options?: FsckOptions): FsckReport {
+    return this.run('fsck', '/', () => {
+      if (this.credentials.uid !== 0) throw new FsError('EPERM')
+      const running = this.readFsckState()
+      if (running && !running.done) throw new FsError('EBUSY')
+      const state: FsckState = { done: false, repair: !!options?.repair, issues: [], phase: 'tree', after: 0 }
+      if (options?.background) {
+        this.saveFsckState(state)
+        this.scheduleAlarm(Date.now())
+      } else {
+        while (!state.done) this.fsckSlice(state)
+        this.saveFsckState(state)
+      }
+      return { done: state.done, repair: state.repair, issues: state.issues }
+    })
+  }
+
+  // Report of the running or most recent fsck
+  public fsckStatus(): FsckReport | undefined {
+    return this.run('fsckStatus', '/', () => {
+      const state = this.readFsckState()
+      return state && { done: state.done, repair: state.repair, issues: state.issues }
+    })
+  }
+
+  // Move chunks of cold files to R2 now instead of waiting for the alarm. Returns how many were moved
+  public async tier(options?: TierOptions) {
+    return this.run('tier', '/', async () => {
+      if (!this.options.tiering) throw new FsError('ENOTSUP')
+      if (this.credentials.uid !== 0) throw new FsError('EPERM')
+      return this.tierChunks(options?.limit ?? TIER_BATCH_SIZE)
+    })
+  }
+
+  // Bring a file's chunks back from R2, e.g. ahead of many small reads
+  public async recall(path: string) {
+    return this.run('recall', path, async () => {
+      const ino = this.resolvePathToInode(path)
+      const attr = this.readAttr(ino)
+      if (attr.kind === 'Directory') throw new FsError('EISDIR')
+      this.checkAccess(attr, R_OK)
+      await this.recallChunks(ino)
+      this.reindex(ino)
+    })
+  }
+
+  // Runs background work that is due, such as purging expired trash.
+  // withDofs and @Dofs call this from the Durable Object's alarm() handler.
+  public async alarm() {
+    let more = false
+    try {
+      this.deleteExpired()
+      const retention = this.trashRetention()
+      if (retention !== undefined) this.purgeTrash(Date.now() - retention)
+      if (this.versioning()?.maxAgeMs !== undefined) {
+        this.pruneVersions()
+        this.updateSpaceUsed()
+      }
+      const fsck = this.readFsckState()
+      if (fsck && !fsck.done) {
+        this.fsckSlice(fsck)
+        this.saveFsckState(fsck)
+      }
+      if (this.options.tiering) {
+        await this.deleteOrphanedObjects()
+        more = (await this.tierChunks(TIER_BATCH_SIZE)) === TIER_BATCH_SIZE
+      }
+    } finally {
+      this.scheduleNextAlarm()
+      // A full batch means there are probably more cold chunks waiting
+      if (more) this.scheduleAlarm(Date.now())
+    }
   }
 
   public getDeviceStats(): DeviceStats {
     const size = this.getDeviceSize()
     const used = this.getSpaceUsed()
-    return {
+    const stats: DeviceStats = {
       deviceSize: size,
       spaceUsed: used,
       spaceAvailable: size - used,
     }
+    if (this.options.tiering) {
+      const row = this.sql
+        .exec(`SELECT COALESCE(SUM(length), 0) AS total FROM ${this.tables.chunks} WHERE location IS NOT NULL`)
+        .next().value
+      stats.tieredBytes = Number(row?.total ?? 0)
+    }
+    return stats
   }
 
   public setDeviceSize(newSize: number) {
+    if (this.credentials.uid !== 0) throw new FsError('EPERM', 'setDeviceSize')
     const used = this.getSpaceUsed()
     if (newSize < used) {
-      throw Object.assign(new Error('ENOSPC'), { code: 'ENOSPC' })
+      throw new FsError('ENOSPC', 'setDeviceSize')
     }
-    this.ctx.storage.sql.exec('UPDATE dofs_meta SET value = ? WHERE key = ?', newSize.toString(), 'device_size')
+    this.sql.exec(`UPDATE ${this.tables.meta} SET value = ? WHERE key = ?`, newSize.toString(), 'device_size')
+  }
+
+  // Add a column to a table created by an older version of dofs
+  private ensureColumn(table: string, column: string, definition: string) {
+    const row = this.sql
+      .exec(`SELECT COUNT(*) AS count FROM pragma_table_info('${table}') WHERE name = ?`, column)
+      .next().value
+    if (!row || Number(row.count) === 0) this.sql.exec(`ALTER TABLE ${table} ADD COLUMN ${column} ${definition}`)
   }
 
   private rootDirAttr() {
@@ -613,12 +1722,13 @@ export class Fs extends RpcTarget {
   }
 
   private ensureSchema() {
-    this.ctx.storage.sql.exec(`
-      CREATE TABLE IF NOT EXISTS dofs_meta (
+    ensureAlarmTable(this.ctx.storage)
+    this.sql.exec(`
+      CREATE TABLE IF NOT EXISTS ${this.tables.meta} (
         key TEXT PRIMARY KEY,
         value TEXT
       );
-      CREATE TABLE IF NOT EXISTS dofs_files (
+      CREATE TABLE IF NOT EXISTS ${this.tables.files} (
         ino INTEGER PRIMARY KEY,
         name TEXT NOT NULL,
         parent INTEGER,
@@ -626,41 +1736,103 @@ export class Fs extends RpcTarget {
         attr BLOB,
         data BLOB
       );
-      CREATE TABLE IF NOT EXISTS dofs_chunks (
+      CREATE TABLE IF NOT EXISTS ${this.tables.chunks} (
         ino INTEGER NOT NULL,
         offset INTEGER NOT NULL,
         data BLOB NOT NULL,
         length INTEGER NOT NULL,
         PRIMARY KEY (ino, offset)
       );
-      CREATE INDEX IF NOT EXISTS idx_dofs_files_parent_name ON dofs_files(parent, name);
-      CREATE INDEX IF NOT EXISTS idx_dofs_files_parent ON dofs_files(parent);
-      CREATE INDEX IF NOT EXISTS idx_dofs_files_name ON dofs_files(name);
-      CREATE INDEX IF NOT EXISTS idx_dofs_chunks_ino ON dofs_chunks(ino);
-      CREATE INDEX IF NOT EXISTS idx_dofs_chunks_ino_offset ON dofs_chunks(ino, offset);
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.files}_parent_name ON ${this.tables.files}(parent, name);
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.files}_parent ON ${this.tables.files}(parent);
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.files}_name ON ${this.tables.files}(name);
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.chunks}_ino ON ${this.tables.chunks}(ino);
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.chunks}_ino_offset ON ${this.tables.chunks}(ino, offset);
+      CREATE TABLE IF NOT EXISTS ${this.tables.trash} (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        ino INTEGER NOT NULL,
+        path TEXT NOT NULL,
+        deleted_at INTEGER NOT NULL,
+        uid INTEGER NOT NULL
+      );
+      CREATE TABLE IF NOT EXISTS ${this.tables.versions} (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        ino INTEGER NOT NULL,
+        size INTEGER NOT NULL,
+        mtime INTEGER NOT NULL,
+        created_at INTEGER NOT NULL
+      );
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.versions}_ino ON ${this.tables.versions}(ino);
+      CREATE TABLE IF NOT EXISTS ${this.tables.audit} (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        at INTEGER NOT NULL,
+        actor TEXT,
+        uid INTEGER NOT NULL,
+        method TEXT NOT NULL,
+        path TEXT NOT NULL,
+        dest TEXT,
+        bytes INTEGER NOT NULL,
+        result TEXT NOT NULL
+      );
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.audit}_at ON ${this.tables.audit}(at);
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.audit}_actor ON ${this.tables.audit}(actor, id);
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.files}_expires_at ON ${this.tables.files}(json_extract(attr, '$.expiresAt'))
+        WHERE json_extract(attr, '$.expiresAt') IS NOT NULL;
+    `)
+    this.ensureColumn(this.tables.chunks, 'checksum', 'TEXT')
+    // The R2 key of a tiered chunk, whose data is then empty. Objects no longer referenced by any chunk
+    // are recorded by the triggers and deleted by the alarm.
+    this.ensureColumn(this.tables.chunks, 'location', 'TEXT')
+    this.sql.exec(`
+      CREATE INDEX IF NOT EXISTS idx_${this.tables.chunks}_location ON ${this.tables.chunks}(location) WHERE location IS NOT NULL;
+      CREATE TABLE IF NOT EXISTS ${this.tables.tierOrphans} (key TEXT PRIMARY KEY);
+      CREATE TRIGGER IF NOT EXISTS ${this.tables.chunks}_tier_delete AFTER DELETE ON ${this.tables.chunks}
+        WHEN OLD.location IS NOT NULL
+      BEGIN
+        INSERT OR IGNORE INTO ${this.tables.tierOrphans} (key) VALUES (OLD.location);
+      END;
+      CREATE TRIGGER IF NOT EXISTS ${this.tables.chunks}_tier_update AFTER UPDATE OF location ON ${this.tables.chunks}
+        WHEN OLD.location IS NOT NULL AND NEW.location IS NOT OLD.location
+      BEGIN
+        INSERT OR IGNORE INTO ${this.tables.tierOrphans} (key) VALUES (OLD.location);
+      END;
     `)
+    if (this.options.paths?.caseInsensitive) {
+      this.sql.exec(
+        `CREATE INDEX IF NOT EXISTS idx_${this.tables.files}_parent_name_nocase ON ${this.tables.files}(parent, name COLLATE NOCASE)`
+      )
+    }
+    if (this.options.indexText) {
+      // rowid is the file's inode
+      this.sql.exec(`CREATE VIRTUAL TABLE IF NOT EXISTS ${this.tables.text} USING fts5(content)`)
+    }
 
     // Ensure meta row exists
-    const metaCursor = this.ctx.storage.sql.exec('SELECT value FROM dofs_meta WHERE key = ?', 'device_size')
+    const metaCursor = this.sql.exec(`SELECT value FROM ${this.tables.meta} WHERE key = ?`, 'device_size')
     if (!metaCursor.next().value) {
-      this.ctx.storage.sql.exec(
-        'INSERT INTO dofs_meta (key, value) VALUES (?, ?)',
+      this.sql.exec(
+        `INSERT INTO ${this.tables.meta} (key, value) VALUES (?, ?)`,
         'device_size',
         (1024 * 1024 * 1024).toString()
       )
     }
-    const usedCursor = this.ctx.storage.sql.exec('SELECT value FROM dofs_meta WHERE key = ?', 'space_used')
+    const usedCursor = this.sql.exec(`SELECT value FROM ${this.tables.meta} WHERE key = ?`, 'space_used')
     if (!usedCursor.next().value) {
-      this.ctx.storage.sql.exec('INSERT INTO dofs_meta (key, value) VALUES (?, ?)', 'space_used', '0')
+      this.sql.exec(`INSERT INTO ${this.tables.meta} (key, value) VALUES (?, ?)`, 'space_used', '0')
     }
+    // Filesystems from before the counter continue after their highest inode
+    this.sql.exec(
+      `INSERT OR IGNORE INTO ${this.tables.meta} (key, value) SELECT 'next_ino', COALESCE(MAX(ino), 1) + 1 FROM ${this.tables.files}`
+    )
+    this.sql.exec(`INSERT OR IGNORE INTO ${this.tables.meta} (key, value) VALUES ('generation', '1')`)
 
     // Ensure root exists
-    const cursor = this.ctx.storage.sql.exec('SELECT COUNT(*) as count FROM dofs_files WHERE ino = ?', 1)
+    const cursor = this.sql.exec(`SELECT COUNT(*) as count FROM ${this.tables.files} WHERE ino = ?`, 1)
     const row = cursor.next().value
     if (!row || row.count === 0) {
       const attr = this.rootDirAttr()
-      this.ctx.storage.sql.exec(
-        'INSERT INTO dofs_files (ino, name, parent, is_dir, attr, data) VALUES (?, ?, ?, ?, ?, NULL)',
+      this.sql.exec(
+        `INSERT INTO ${this.tables.files} (ino, name, parent, is_dir, attr, data) VALUES (?, ?, ?, ?, ?, NULL)`,
         1,
         '/',
         undefined,
@@ -670,70 +1842,1247 @@ export class Fs extends RpcTarget {
     }
   }
 
-  // Add a sync version of resolvePathToInode for use in sync methods
-  private resolvePathToInode(path: string): number {
-    if (path === '/' || path === '') return 1
-    const parts = path.split('/').filter(Boolean)
+  // Run a public operation, attaching the syscall and paths to any FsError raised along the way. The path can be a
+  // function for operations that only find it out as they run.
+  private run<T>(
+    method: string,
+    pathOrGetter: string | (() => string),
+    ...args: [fn: () => T] | [dest: string, fn: () => T]
+  ): T {
+    const fn = args.length === 1 ? args[0] : args[1]
+    const dest = args.length === 1 ? undefined : args[0]
+    const path = () => (typeof pathOrGetter === 'string' ? pathOrGetter : pathOrGetter())
+    const syscall = SYSCALLS[method] ?? method
+    const annotate = (e: unknown) => (e instanceof FsError ? e.withContext(syscall, path(), dest) : e)
+    // Calls Fs makes to itself, like writeFile to write, count towards the outer method only
+    const outermost = this.activeMethod === undefined
+    const start = Date.now()
+    const bytes = this.metrics.bytesRead + this.metrics.bytesWritten
+    const record = (code?: string) => {
+      if (!outermost) return
+      this.metrics.call(method, Date.now() - start, code)
+      this.audit(method, path(), dest, this.metrics.bytesRead + this.metrics.bytesWritten - bytes, code ?? 'ok')
+    }
+    const codeOf = (e: unknown) => FsError.from(e)?.code ?? 'unknown'
+    if (outermost) this.activeMethod = method
+    try {
+      const result = fn()
+      if (result instanceof Promise) {
+        return result.then(
+          (value) => {
+            record()
+            return value
+          },
+          (e) => {
+            record(codeOf(e))
+            throw annotate(e)
+          }
+        ) as T
+      }
+      record()
+      return result
+    } catch (e) {
+      record(codeOf(e))
+      throw annotate(e)
+    } finally {
+      if (outermost) this.activeMethod = undefined
+    }
+  }
+
+  // Record a call in the audit log when it's enabled. bytes is what the shared counters moved during the call, so
+  // for a streamed writeFile it can include other calls' bytes that ran concurrently.
+  private audit(method: string, path: string, dest: string | undefined, bytes: number, result: string) {
+    const options = this.options.audit === true ? {} : this.options.audit
+    if (!options || (!MUTATING_METHODS.has(method) && !options.reads)) return
+    const at = Date.now()
+    const row = this.sql
+      .exec(
+        `INSERT INTO ${this.tables.audit} (at, actor, uid, method, path, dest, bytes, result)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+        at,
+        this.options.context?.actor ?? null,
+        this.credentials.uid,
+        method,
+        this.auditPath(path),
+        dest === undefined ? null : this.auditPath(dest),
+        bytes,
+        result
+      )
+      .next().value
+    const id = Number(row!.id)
+    if (id % AUDIT_ROTATE_INTERVAL !== 0) return
+    const maxEntries = options.maxEntries ?? DEFAULT_AUDIT_MAX_ENTRIES
+    const expired = options.retentionMs === undefined ? 0 : at - options.retentionMs
+    this.sql.exec(`DELETE FROM ${this.tables.audit} WHERE id <= ? OR at < ?`, id - maxEntries, expired)
+  }
+
+  // Paths are logged normalized so queries match however the caller spelled them. Invalid paths and inode
+  // references like '#12' are kept as given.
+  private auditPath(path: string) {
+    if (path.startsWith('#')) return path
+    try {
+      return normalizePath(path, this.options.paths)
+    } catch {
+      return path
+    }
+  }
+
+  private parsePath(path: string) {
+    return parsePath(path, this.options.paths)
+  }
+
+  private splitPath(path: string) {
+    return splitPath(path, this.options.paths)
+  }
+
+  // The entry called name in a directory. Case-insensitive lookups fall back to comparing folded names: SQLite's
+  // NOCASE only folds ASCII, so other names are compared in JS against the children of the same length.
+  private findChild(parent: number, name: string) {
+    const columns = "ino, name, is_dir, attr, data, json_extract(attr, '$.kind') AS kind"
+    const row = this.sql
+      .exec(`SELECT ${columns} FROM ${this.tables.files} WHERE parent = ? AND name = ?`, parent, name)
+      .next().value
+    if (row || !this.options.paths?.caseInsensitive) return row
+    if (/^[\x00-\x7f]*$/.test(name)) {
+      return this.sql
+        .exec(`SELECT ${columns} FROM ${this.tables.files} WHERE parent = ? AND name = ? COLLATE NOCASE`, parent, name)
+        .next().value
+    }
+    const folded = foldName(name)
+    return this.sql
+      .exec(
+        `SELECT ${columns} FROM ${this.tables.files} WHERE parent = ? AND length(name) = ?`,
+        parent,
+        [...name].length
+      )
+      .toArray()
+      .find((child) => foldName(String(child.name)) === folded)
+  }
+
+  // Resolve a path to an inode, following symlinks on the way and, unless follow is false, at the end.
+  // '..' is resolved against the directory reached so far, so after a symlink it is the target's parent, and '..'
+  // in a relative target starts from the link's directory.
+  private resolvePathToInode(path: string, follow = true): number {
+    const parts = this.parsePath(path)
+    // Root can search every directory, so only load attrs for other callers
+    const checkPerms = this.credentials.uid !== 0
+    let parentAttr = checkPerms ? this.readAttr(1) : undefined
     let parent = 1
-    for (const name of parts) {
-      const cursor = this.ctx.storage.sql.exec('SELECT ino FROM dofs_files WHERE parent = ? AND name = ?', parent, name)
-      const row = cursor.next().value
-      if (!row || row.ino == null) throw new Error('ENOENT')
+    let isDir = true
+    let links = 0
+    while (parts.length > 0) {
+      const name = parts.shift()!
+      if (!isDir) throw new FsError('ENOTDIR')
+      if (parentAttr) this.checkAccess(parentAttr, X_OK)
+      if (name === '.') continue
+      if (name === '..') {
+        // The root is its own parent
+        const row = this.sql.exec(`SELECT parent FROM ${this.tables.files} WHERE ino = ?`, parent).next().value
+        if (row && row.parent != null) parent = Number(row.parent)
+        if (parentAttr) parentAttr = this.readAttr(parent)
+        continue
+      }
+      const row = this.findChild(parent, name)
+      if (!row || row.ino == null) throw new FsError('ENOENT')
+      if (row.kind === 'Symlink' && (parts.length > 0 || follow)) {
+        if (++links > MAX_SYMLINKS) throw new FsError('ELOOP')
+        const target = new TextDecoder().decode(new Uint8Array(row.data as ArrayBuffer))
+        const names = target.split('/').filter(Boolean)
+        parts.unshift(...(this.options.paths?.normalizeUnicode ? names.map((n) => n.normalize('NFC')) : names))
+        // A relative target continues from the directory containing the link
+        if (target.startsWith('/')) {
+          parent = 1
+          if (parentAttr) parentAttr = this.readAttr(1)
+        }
+        continue
+      }
       parent = Number(row.ino)
+      isDir = !!row.is_dir
+      if (parentAttr) parentAttr = this.parseAttr(row.attr)
     }
     return parent
   }
 
-  // Add a sync version of allocInode for use in sync methods
-  private allocInode(): number {
-    const cursor = this.ctx.storage.sql.exec('SELECT MAX(ino) as max FROM dofs_files')
+  private toStat(ino: number, isDir: boolean, attr: any): Stat {
+    return {
+      // Only regular files; symlinks and special files say so in kind
+      isFile: attr.kind === 'File',
+      isDirectory: isDir,
+      size: attr.size,
+      ino,
+      generation: attr.generation ?? 0,
+      mode: attr.perm,
+      uid: attr.uid,
+      gid: attr.gid,
+      mtime: attr.mtime,
+      ctime: attr.ctime,
+      atime: attr.atime,
+      crtime: attr.crtime,
+      blocks: attr.blocks,
+      nlink: attr.nlink,
+      rdev: attr.rdev,
+      flags: attr.flags,
+      blksize: attr.blksize,
+      kind: attr.kind,
+      digest: attr.digest,
+      expiresAt: attr.expiresAt,
+      contentType: attr.contentType,
+    }
+  }
+
+  // Walk the subtree below a directory in path order with a recursive CTE, filtering in SQL.
+  // `match` can reject paths SQL couldn't; paging then continues until the page is full.
+  private queryTree(rootIno: number, rootPath: string, query: TreeQuery, match?: (path: string) => boolean) {
+    const base = this.parsePath(rootPath).join('/')
+    const limit = query.limit ?? DEFAULT_PAGE_SIZE
+    const filters = ['tree.depth >= ?']
+    const params: (string | number)[] = [query.minDepth ?? 1]
+    if (query.name !== undefined) {
+      filters.push('tree.name GLOB ?')
+      params.push(query.name)
+    }
+    if (query.type !== undefined) {
+      // Callers over RPC can send any string, which would otherwise bind as undefined
+      if (!Object.hasOwn(kindForType, query.type)) throw new FsError('EINVAL')
+      filters.push("json_extract(tree.attr, '$.kind') = ?")
+      params.push(kindForType[query.type])
+    }
+    if (query.minSize !== undefined) {
+      filters.push("json_extract(tree.attr, '$.size') >= ?")
+      params.push(query.minSize)
+    }
+    if (query.maxSize !== undefined) {
+      filters.push("json_extract(tree.attr, '$.size') <= ?")
+      params.push(query.maxSize)
+    }
+    if (query.modifiedAfter !== undefined) {
+      filters.push("json_extract(tree.attr, '$.mtime') > ?")
+      params.push(query.modifiedAfter)
+    }
+    const sql = `
+      WITH RECURSIVE tree(ino, name, path, depth, is_dir, attr) AS (
+        SELECT ino, name, ?, 0, is_dir, attr FROM ${this.tables.files} WHERE ino = ?
+        UNION ALL
+        SELECT f.ino, f.name, tree.path || '/' || f.name, tree.depth + 1, f.is_dir, f.attr
+        FROM ${this.tables.files} f JOIN tree ON f.parent = tree.ino
+        WHERE tree.is_dir AND tree.depth < ? AND ${this.searchableSql('tree.attr')}
+      )
+      SELECT ino, path, is_dir, attr FROM tree
+      WHERE ${filters.join(' AND ')} AND path > ?
+      ORDER BY path LIMIT ?`
+    const maxDepth = query.maxDepth ?? Number.MAX_SAFE_INTEGER
+    const batchSize = match ? Math.max(limit, 100) : limit
+    let after = query.cursor ? this.readCursor<string>(query.cursor) : ''
+    const entries: FindEntry[] = []
+    while (entries.length < limit) {
+      const rows = this.sql
+        .exec(sql, base ? '/' + base : '', rootIno, maxDepth, ...params, after, batchSize)
+        .toArray()
+      for (const row of rows) {
+        after = String(row.path)
+        if (match && !match(after)) continue
+        entries.push({ path: after, stat: this.toStat(Number(row.ino), !!row.is_dir, this.parseAttr(row.attr)) })
+        if (entries.length === limit) return { entries, cursor: encodeCursor(after) }
+      }
+      if (rows.length < batchSize) break
+    }
+    return { entries }
+  }
+
+  // SQL condition that an attr column is a directory the caller may list and search
+  private searchableSql(column: string) {
+    const { uid, gid, groups } = this.credentials
+    if (uid === 0) return '1'
+    const perm = `json_extract(${column}, '$.perm')`
+    const gids = [gid, ...(groups ?? [])].map(Number).join(', ')
+    return `(CASE
+      WHEN json_extract(${column}, '$.uid') = ${Number(uid)} THEN (${perm} >> 6) & 5 = 5
+      WHEN json_extract(${column}, '$.gid') IN (${gids}) THEN (${perm} >> 3) & 5 = 5
+      ELSE ${perm} & 5 = 5
+    END)`
+  }
+
+  private readCursor<T>(cursor: string): T {
+    try {
+      return decodeCursor<T>(cursor)
+    } catch {
+      throw new FsError('EINVAL')
+    }
+  }
+
+  private parseAttr(raw: any) {
+    return typeof raw === 'string' ? JSON.parse(raw) : raw
+  }
+
+  private readAttr(ino: number) {
+    const cursor = this.sql.exec(`SELECT attr FROM ${this.tables.files} WHERE ino = ?`, ino)
     const row = cursor.next().value
-    return row && row.max != null ? Number(row.max) + 1 : 2
+    if (!row || !row.attr) throw new FsError('ENOENT')
+    return this.parseAttr(row.attr)
+  }
+
+  // Check the caller's permission bits against an inode's attr
+  private canAccess(attr: any, mask: number) {
+    const { uid, gid, groups } = this.credentials
+    if (uid === 0) {
+      // Root bypasses read/write checks but can only execute files with some execute bit set
+      return !(mask & X_OK) || attr.kind === 'Directory' || (attr.perm & 0o111) !== 0
+    }
+    let bits = attr.perm & 7
+    if (attr.uid === uid) bits = (attr.perm >> 6) & 7
+    else if (attr.gid === gid || groups?.includes(attr.gid)) bits = (attr.perm >> 3) & 7
+    return (bits & mask) === mask
+  }
+
+  private checkAccess(attr: any, mask: number) {
+    if (!this.canAccess(attr, mask)) throw new FsError('EACCES')
+  }
+
+  // Check the caller may remove an inode from its parent directory, honoring the sticky bit.
+  // Returns the parent inode.
+  private checkRemove(ino: number): number {
+    const cursor = this.sql.exec(`SELECT parent, attr FROM ${this.tables.files} WHERE ino = ?`, ino)
+    const row = cursor.next().value
+    if (!row) throw new FsError('ENOENT')
+    if (row.parent == null) throw new FsError('EBUSY')
+    const parentAttr = this.readAttr(Number(row.parent))
+    this.checkAccess(parentAttr, W_OK | X_OK)
+    const { uid } = this.credentials
+    if (parentAttr.perm & S_ISVTX && uid !== 0 && uid !== parentAttr.uid && uid !== this.parseAttr(row.attr).uid) {
+      throw new FsError('EPERM')
+    }
+    return Number(row.parent)
+  }
+
+  // Owner for a new inode; setgid directories pass their group down
+  private newOwner(parentAttr: any) {
+    const { uid, gid } = this.credentials
+    return { uid, gid: parentAttr.perm & S_ISGID ? parentAttr.gid : gid }
+  }
+
+  // Where writing to a missing path creates the file: like open(2) with O_CREAT, a symlink at the end is followed,
+  // so a dangling link gets its target created. Errors are left for create to report.
+  private danglingTarget(path: string) {
+    let links = 0
+    while (true) {
+      const { name, parent: parentPath } = this.splitPath(path)
+      if (name === undefined) return path
+      let parent: number
+      try {
+        parent = this.resolvePathToInode(parentPath)
+      } catch {
+        return path
+      }
+      const row = this.findChild(parent, name)
+      if (!row || row.kind !== 'Symlink') return path
+      if (++links > MAX_SYMLINKS) throw new FsError('ELOOP')
+      const target = new TextDecoder().decode(new Uint8Array(row.data as ArrayBuffer))
+      // A relative target is resolved from the directory holding the link
+      path = target.startsWith('/') ? target : joinPath(this.pathOfInode(parent) ?? '/', target)
+    }
+  }
+
+  // Make a new non-directory entry with no content: a regular file, FIFO, socket or device node
+  private createNode(path: string, kind: string, options?: CreateOptions, rdev = 0) {
+    const { name, parent: parentPath } = this.splitPath(path)
+    if (name === undefined) throw new FsError('EEXIST')
+    const parent = this.resolvePathToInode(parentPath)
+    // Check if already exists
+    if (this.findChild(parent, name)) throw new FsError('EEXIST')
+    const parentAttr = this.readAttr(parent)
+    this.checkAccess(parentAttr, W_OK | X_OK)
+    const { ino, generation } = this.allocInode()
+    const now = Date.now()
+    const mode = options?.mode ?? 0o644
+    const umask = options?.umask ?? 0
+    const perm = mode & ~umask & 0o7777
+    const { uid, gid } = this.newOwner(parentAttr)
+    const attr = {
+      ino,
+      generation,
+      size: 0,
+      blocks: 0,
+      atime: now,
+      mtime: now,
+      ctime: now,
+      crtime: now,
+      kind,
+      perm,
+      nlink: 1,
+      uid,
+      gid,
+      rdev,
+      flags: 0,
+      blksize: 512,
+    }
+    this.sql.exec(
+      `INSERT INTO ${this.tables.files} (ino, name, parent, is_dir, attr, data) VALUES (?, ?, ?, ?, ?, NULL)`,
+      ino,
+      name,
+      parent,
+      0,
+      JSON.stringify(attr)
+    )
+    this.touchDir(parent)
+  }
+
+  // Inode numbers come from a counter that only goes up, so deleting a file never frees its number for the
+  // next one. The generation only changes if fsck has to move the counter, making (ino, generation) unique.
+  private allocInode() {
+    const row = this.sql
+      .exec(`UPDATE ${this.tables.meta} SET value = value + 1 WHERE key = 'next_ino' RETURNING value`)
+      .next().value
+    return { ino: Number(row!.value) - 1, generation: this.inodeGeneration() }
+  }
+
+  private inodeGeneration() {
+    const row = this.sql.exec(`SELECT value FROM ${this.tables.meta} WHERE key = 'generation'`).next().value
+    return Number(row?.value ?? 1)
+  }
+
+  // A live inode's attributes, ESTALE if the caller's generation is out of date or the inode is gone
+  private readInode(ino: number, generation?: number) {
+    const row = this.sql.exec(`SELECT is_dir, attr FROM ${this.tables.files} WHERE ino = ?`, ino).next().value
+    const attr = row ? this.parseAttr(row.attr) : undefined
+    // Trashed entries keep their rows but are detached from the tree
+    const live = attr && this.pathOfInode(ino) !== undefined
+    if (generation !== undefined && (!live || (attr.generation ?? 0) !== generation)) throw new FsError('ESTALE')
+    if (!live) throw new FsError('ENOENT')
+    // An inode number is no way round the permissions on the directories above it
+    this.checkAncestors(ino)
+    return { isDir: !!row!.is_dir, attr }
   }
 
-  // Helper to load a chunk as Uint8Array, or zero-filled if not present
-  private loadChunk(ino: number, chunkOffset: number, chunkSize: number): Uint8Array {
-    const chunkCursor = this.ctx.storage.sql.exec(
-      'SELECT data FROM dofs_chunks WHERE ino = ? AND offset = ?',
+  // Check the caller may search every directory above an inode, as resolving its path would require
+  private checkAncestors(ino: number) {
+    if (this.credentials.uid === 0) return
+    const rows = this.sql
+      .exec(
+        `WITH RECURSIVE up(ino, parent, depth) AS (
+          SELECT ino, parent, 0 FROM ${this.tables.files} WHERE ino = ?
+          UNION ALL
+          SELECT f.ino, f.parent, up.depth + 1 FROM ${this.tables.files} f JOIN up ON f.ino = up.parent
+          WHERE up.depth < 4096
+        )
+        SELECT f.attr FROM up JOIN ${this.tables.files} f ON f.ino = up.parent ORDER BY up.depth DESC`,
+        ino
+      )
+      .toArray()
+    for (const row of rows) this.checkAccess(this.parseAttr(row.attr), X_OK)
+  }
+
+  // Helper to load a chunk into a zero-filled buffer of chunkSize, along with its stored length
+  private loadChunk(ino: number, chunkOffset: number, chunkSize: number): { data: Uint8Array; length: number } {
+    const chunkCursor = this.sql.exec(
+      `SELECT data FROM ${this.tables.chunks} WHERE ino = ? AND offset = ?`,
       ino,
       chunkOffset
     )
     const chunkRow = chunkCursor.next().value
+    const data = new Uint8Array(chunkSize)
+    let stored: Uint8Array | undefined
     if (chunkRow && chunkRow.data) {
       if (chunkRow.data instanceof ArrayBuffer) {
-        return new Uint8Array(chunkRow.data)
+        stored = new Uint8Array(chunkRow.data)
       } else if (ArrayBuffer.isView(chunkRow.data)) {
-        return new Uint8Array(chunkRow.data.buffer)
+        stored = new Uint8Array(chunkRow.data.buffer, chunkRow.data.byteOffset, chunkRow.data.byteLength)
       }
     }
-    return new Uint8Array(chunkSize)
+    if (!stored) return { data, length: 0 }
+    data.set(stored.subarray(0, chunkSize))
+    return { data, length: Math.min(stored.length, chunkSize) }
   }
 
   // Helper to get/set device size and space used
   private getDeviceSize(): number {
-    const cursor = this.ctx.storage.sql.exec('SELECT value FROM dofs_meta WHERE key = ?', 'device_size')
+    const cursor = this.sql.exec(`SELECT value FROM ${this.tables.meta} WHERE key = ?`, 'device_size')
     const row = cursor.next().value
     return row ? Number(row.value) : 1024 * 1024 * 1024
   }
   private getSpaceUsed(): number {
-    const cursor = this.ctx.storage.sql.exec('SELECT value FROM dofs_meta WHERE key = ?', 'space_used')
+    const cursor = this.sql.exec(`SELECT value FROM ${this.tables.meta} WHERE key = ?`, 'space_used')
     const row = cursor.next().value
     return row ? Number(row.value) : 0
   }
   private setSpaceUsed(val: number) {
-    this.ctx.storage.sql.exec('UPDATE dofs_meta SET value = ? WHERE key = ?', val.toString(), 'space_used')
+    this.sql.exec(`UPDATE ${this.tables.meta} SET value = ? WHERE key = ?`, val.toString(), 'space_used')
   }
   private updateFileSizeAndSpaceUsed(ino: number) {
     // Sum all chunk lengths for this ino
-    const cursor = this.ctx.storage.sql.exec('SELECT SUM(length) as total FROM dofs_chunks WHERE ino = ?', ino)
+    const cursor = this.sql.exec(`SELECT SUM(length) as total FROM ${this.tables.chunks} WHERE ino = ?`, ino)
     const row = cursor.next().value
     const size = row && row.total ? Number(row.total) : 0
     // Update file attr
-    this.ctx.storage.sql.exec('UPDATE dofs_files SET attr = json_set(attr, "$.size", ?) WHERE ino = ?', size, ino)
+    this.sql.exec(`UPDATE ${this.tables.files} SET attr = json_set(attr, '$.size', ?) WHERE ino = ?`, size, ino)
+    this.updateSpaceUsed()
+  }
+  private updateSpaceUsed() {
     // Update space_used (sum all chunk lengths for all files)
-    const usedCursor = this.ctx.storage.sql.exec('SELECT SUM(length) as total FROM dofs_chunks')
+    const usedCursor = this.sql.exec(`SELECT SUM(length) as total FROM ${this.tables.chunks}`)
     const usedRow = usedCursor.next().value
     const used = usedRow && usedRow.total ? Number(usedRow.total) : 0
     this.setSpaceUsed(used)
   }
+
+  // Set timestamps on an inode's attr
+  private touch(ino: number, times: { atime?: number; mtime?: number; ctime?: number }) {
+    const entries = Object.entries(times).filter(([, v]) => v !== undefined)
+    if (entries.length === 0) return
+    const paths = entries.map(([k]) => `'$.${k}', ?`).join(', ')
+    this.sql.exec(
+      `UPDATE ${this.tables.files} SET attr = json_set(attr, ${paths}) WHERE ino = ?`,
+      ...entries.map(([, v]) => v),
+      ino
+    )
+  }
+
+  // Update a directory after an entry was added or removed, adjusting nlink for subdirectories
+  private touchDir(ino: number, nlinkDelta = 0) {
+    const now = Date.now()
+    this.sql.exec(
+      `UPDATE ${this.tables.files} SET attr = json_set(attr, '$.mtime', ?, '$.ctime', ?, '$.nlink', max(json_extract(attr, '$.nlink') + ?, 2)) WHERE ino = ?`,
+      now,
+      now,
+      nlinkDelta,
+      ino
+    )
+  }
+
+  // Update atime after a read according to the atime policy
+  private touchAtime(ino: number, attr: any) {
+    if (this.atimePolicy === 'noatime') return
+    const now = Date.now()
+    if (
+      this.atimePolicy === 'relatime' &&
+      attr.atime > attr.mtime &&
+      attr.atime > attr.ctime &&
+      now - attr.atime < RELATIME_INTERVAL
+    ) {
+      return
+    }
+    this.touch(ino, { atime: now })
+  }
+
+  // Swap two entries for rename(..., { exchange: true }); ino is already checked for removal and the move
+  private exchange(
+    ino: number,
+    attr: any,
+    oldParent: number,
+    oldName: string,
+    otherIno: number,
+    newParent: number,
+    newName: string
+  ) {
+    this.checkRemove(otherIno)
+    this.checkAccess(this.readAttr(oldParent), W_OK | X_OK)
+    const otherAttr = this.readAttr(otherIno)
+    if (otherAttr.kind === 'Directory') {
+      if (newParent !== oldParent) this.checkAccess(otherAttr, W_OK)
+      if (this.isWithin(oldParent, otherIno)) throw new FsError('EINVAL')
+    }
+    this.sql.exec(`UPDATE ${this.tables.files} SET parent = ?, name = ? WHERE ino = ?`, newParent, newName, ino)
+    this.sql.exec(`UPDATE ${this.tables.files} SET parent = ?, name = ? WHERE ino = ?`, oldParent, oldName, otherIno)
+    // Each parent gains the other's directory link
+    const dirs = (attr.kind === 'Directory' ? 1 : 0) - (otherAttr.kind === 'Directory' ? 1 : 0)
+    this.touchDir(newParent, newParent === oldParent ? 0 : dirs)
+    if (newParent !== oldParent) this.touchDir(oldParent, -dirs)
+    const now = Date.now()
+    this.touch(ino, { ctime: now })
+    this.touch(otherIno, { ctime: now })
+  }
+
+  // Whether ino is dir itself or somewhere below it
+  private isWithin(ino: number, dir: number) {
+    const row = this.sql
+      .exec(
+        `WITH RECURSIVE up(ino) AS (
+          SELECT ? UNION
+          SELECT f.parent FROM ${this.tables.files} f JOIN up ON f.ino = up.ino WHERE f.parent IS NOT NULL
+        )
+        SELECT 1 AS found FROM up WHERE ino = ? LIMIT 1`,
+        ino,
+        dir
+      )
+      .next().value
+    return !!row
+  }
+
+  // Copy an inode to dest. File data is duplicated chunk by chunk in SQL without leaving the DO
+  private copyEntry(ino: number, attr: any, dest: string, options: CpOptions) {
+    this.checkAccess(attr, attr.kind === 'Directory' ? R_OK | X_OK : R_OK)
+    const { name, parent: parentPath } = this.splitPath(dest)
+    if (name === undefined) throw new FsError('EEXIST')
+    const parent = this.resolvePathToInode(parentPath)
+    const existing = this.findChild(parent, name)
+    const existingIno = existing ? Number(existing.ino) : undefined
+    const existingAttr = existing ? this.parseAttr(existing.attr) : undefined
+    if (existingIno === ino) throw new FsError('EINVAL')
+    let destIno: number
+    if (attr.kind === 'Directory') {
+      if (existingAttr && existingAttr.kind !== 'Directory') throw new FsError('ENOTDIR')
+      if (existingIno === undefined) this.mkdir(dest, { mode: attr.perm })
+      destIno = existingIno ?? this.resolvePathToInode(dest, false)
+      const children = this.sql.exec(`SELECT ino, name, attr FROM ${this.tables.files} WHERE parent = ?`, ino).toArray()
+      for (const child of children) {
+        const childDest = dest.endsWith('/') ? dest + child.name : `${dest}/${child.name}`
+        this.copyEntry(Number(child.ino), this.parseAttr(child.attr), childDest, options)
+      }
+    } else {
+      if (existingAttr) {
+        if (!options.overwrite) throw new FsError('EEXIST')
+        if (existingAttr.kind === 'Directory') throw new FsError('EISDIR')
+      }
+      if (attr.kind === 'Symlink') {
+        if (existingIno !== undefined) this.unlink(dest, { permanent: true })
+        const row = this.sql.exec(`SELECT data FROM ${this.tables.files} WHERE ino = ?`, ino).next().value
+        this.symlink(new TextDecoder().decode(new Uint8Array(row!.data as ArrayBuffer)), dest)
+        destIno = this.resolvePathToInode(dest, false)
+      } else if (isSpecial(attr.kind)) {
+        // Like cp -R, special files are recreated rather than read
+        if (existingIno !== undefined) this.unlink(dest, { permanent: true })
+        this.mknod(dest, { kind: attr.kind, mode: attr.perm, rdev: attr.rdev })
+        destIno = this.resolvePathToInode(dest, false)
+      } else {
+        if (existingAttr && existingAttr.kind !== 'File') this.unlink(dest, { permanent: true })
+        else if (existingAttr) this.checkAccess(existingAttr, W_OK)
+        const reused = existingAttr?.kind === 'File' ? existingIno : undefined
+        const srcBytes = this.chunkBytes(ino)
+        const destBytes = reused === undefined ? 0 : this.chunkBytes(reused)
+        if (this.getSpaceUsed() - destBytes + srcBytes > this.getDeviceSize()) throw new FsError('ENOSPC')
+        if (reused === undefined) this.create(dest, { mode: attr.perm })
+        destIno = reused ?? this.resolvePathToInode(dest, false)
+        this.sql.exec(`DELETE FROM ${this.tables.chunks} WHERE ino = ?`, destIno)
+        this.sql.exec(
+          `INSERT INTO ${this.tables.chunks} (ino, offset, data, length, checksum, location) SELECT ?, offset, data, length, checksum, location FROM ${this.tables.chunks} WHERE ino = ?`,
+          destIno,
+          ino
+        )
+        this.setContentType(destIno, attr.contentType)
+        this.updateFileSizeAndSpaceUsed(destIno)
+        const now = Date.now()
+        this.touch(destIno, { mtime: now, ctime: now })
+        this.reindex(destIno)
+      }
+    }
+    // Applied last so copying a directory's children doesn't bump its times again
+    if (options.preserve) {
+      this.touch(destIno, { atime: attr.atime, mtime: attr.mtime })
+      if (this.credentials.uid === 0) {
+        this.sql.exec(
+          `UPDATE ${this.tables.files} SET attr = json_set(attr, '$.uid', ?, '$.gid', ?, '$.perm', ?) WHERE ino = ?`,
+          attr.uid,
+          attr.gid,
+          attr.perm,
+          destIno
+        )
+      }
+    }
+  }
+
+  private chunkBytes(ino: number) {
+    const row = this.sql.exec(`SELECT SUM(length) AS total FROM ${this.tables.chunks} WHERE ino = ?`, ino).next().value
+    return row && row.total ? Number(row.total) : 0
+  }
+
+  private versioning(): VersioningOptions | undefined {
+    const versioning = this.options.versioning
+    if (!versioning) return undefined
+    return versioning === true ? {} : versioning
+  }
+
+  private readVersion(ino: number, version: number): FileVersion {
+    const row = this.sql
+      .exec(`SELECT id, size, mtime, created_at FROM ${this.tables.versions} WHERE id = ? AND ino = ?`, version, ino)
+      .next().value
+    if (!row) throw new FsError('ENOENT')
+    return { version: Number(row.id), size: Number(row.size), mtime: Number(row.mtime), createdAt: Number(row.created_at) }
+  }
+
+  // Record a file's current content as a version. With `move`, its chunk rows are handed over instead of
+  // copied, for callers that are about to drop them anyway
+  private snapshotVersion(ino: number, attr: any, move: boolean) {
+    if (!move && this.getSpaceUsed() + this.chunkBytes(ino) > this.getDeviceSize()) throw new FsError('ENOSPC')
+    const now = Date.now()
+    const row = this.sql
+      .exec(
+        `INSERT INTO ${this.tables.versions} (ino, size, mtime, created_at) VALUES (?, ?, ?, ?) RETURNING id`,
+        ino,
+        attr.size || 0,
+        attr.mtime,
+        now
+      )
+      .next().value!
+    const storage = -Number(row.id)
+    if (move) {
+      this.sql.exec(`UPDATE ${this.tables.chunks} SET ino = ? WHERE ino = ?`, storage, ino)
+    } else {
+      this.sql.exec(
+        `INSERT INTO ${this.tables.chunks} (ino, offset, data, length, checksum, location) SELECT ?, offset, data, length, checksum, location FROM ${this.tables.chunks} WHERE ino = ?`,
+        storage,
+        ino
+      )
+    }
+    const maxAgeMs = this.versioning()?.maxAgeMs
+    if (maxAgeMs !== undefined) this.scheduleAlarm(now + maxAgeMs)
+  }
+
+  // Apply retention limits, for one file or (by age only) for all of them
+  private pruneVersions(ino?: number) {
+    const { maxVersions = DEFAULT_MAX_VERSIONS, maxAgeMs } = this.versioning() ?? {}
+    const expired =
+      ino === undefined
+        ? []
+        : this.sql
+            .exec(
+              `SELECT id FROM ${this.tables.versions} WHERE ino = ? ORDER BY id DESC LIMIT -1 OFFSET ?`,
+              ino,
+              maxVersions
+            )
+            .toArray()
+    if (maxAgeMs !== undefined) {
+      expired.push(
+        ...this.sql
+          .exec(
+            `SELECT id FROM ${this.tables.versions} WHERE created_at < ? ${ino === undefined ? '' : 'AND ino = ?'}`,
+            Date.now() - maxAgeMs,
+            ...(ino === undefined ? [] : [ino])
+          )
+          .toArray()
+      )
+    }
+    for (const { id } of expired) {
+      this.sql.exec(`DELETE FROM ${this.tables.chunks} WHERE ino = ?`, -Number(id))
+      this.sql.exec(`DELETE FROM ${this.tables.versions} WHERE id = ?`, id)
+    }
+  }
+
+  // Delete a batch of entries whose expiry has passed, bypassing the trash
+  // Expiry is the filesystem's own work, so entries are removed directly rather than with unlink() and rmdir(),
+  // which would check the permissions of whatever credentials this Fs has
+  private deleteExpired() {
+    const rows = this.sql
+      .exec(
+        `SELECT ino, parent, is_dir FROM ${this.tables.files} WHERE json_extract(attr, '$.expiresAt') <= ?
+        ORDER BY json_extract(attr, '$.expiresAt') LIMIT ?`,
+        Date.now(),
+        EXPIRE_BATCH_SIZE
+      )
+      .toArray()
+    for (const row of rows) {
+      const ino = Number(row.ino)
+      try {
+        if (this.pathOfInode(ino) === undefined) {
+          // Already in the trash (or below an expired directory deleted earlier in this batch). The trash's own
+          // retention decides when it goes, and it comes back without an expiry if restored.
+          this.clearExpiry(ino)
+        } else {
+          this.removeTree(ino)
+          this.touchDir(Number(row.parent), row.is_dir ? -1 : 0)
+        }
+      } catch (e) {
+        // One entry failing mustn't hold up the rest, or the alarm's other work
+        console.error(`dofs: failed to delete expired inode ${ino}`, e)
+        this.sql.exec(
+          `UPDATE ${this.tables.files} SET attr = json_set(attr, '$.expiresAt', ?) WHERE ino = ?`,
+          Date.now() + EXPIRE_RETRY_DELAY,
+          ino
+        )
+      }
+    }
+    if (rows.length > 0) this.updateSpaceUsed()
+  }
+
+  private clearExpiry(ino: number) {
+    this.sql.exec(`UPDATE ${this.tables.files} SET attr = json_remove(attr, '$.expiresAt') WHERE ino = ?`, ino)
+  }
+
+  private readFsckState(): FsckState | undefined {
+    const row = this.sql.exec(`SELECT value FROM ${this.tables.meta} WHERE key = ?`, 'fsck').next().value
+    return row ? JSON.parse(String(row.value)) : undefined
+  }
+
+  private saveFsckState(state: FsckState) {
+    this.sql.exec(
+      `INSERT OR REPLACE INTO ${this.tables.meta} (key, value) VALUES (?, ?)`,
+      'fsck',
+      JSON.stringify(state)
+    )
+  }
+
+  // Examine up to FSCK_SLICE_SIZE rows of the current phase, moving on to the next phase when it's exhausted
+  private fsckSlice(state: FsckState) {
+    const sql = this.sql
+    const report = (issue: Omit<FsckIssue, 'repaired'>) => state.issues.push({ ...issue, repaired: state.repair })
+    if (state.phase === 'tree') {
+      const rows = sql
+        .exec(
+          `SELECT ino FROM ${this.tables.files} WHERE ino > ? AND ino != 1 ORDER BY ino LIMIT ?`,
+          state.after,
+          FSCK_SLICE_SIZE
+        )
+        .toArray()
+      for (const row of rows) {
+        const ino = Number(row.ino)
+        const problem = this.fsckTreeProblem(ino)
+        if (problem) {
+          report({ kind: problem, ino })
+          if (state.repair) this.moveToLostFound(ino)
+        }
+        state.after = ino
+      }
+      if (rows.length < FSCK_SLICE_SIZE) Object.assign(state, { phase: 'chunks', after: -Number.MAX_SAFE_INTEGER })
+    } else if (state.phase === 'chunks') {
+      // Negative inodes hold versions, keyed by the negated version id
+      const rows = sql
+        .exec(
+          `SELECT c.ino, CASE WHEN c.ino > 0
+            THEN EXISTS (SELECT 1 FROM ${this.tables.files} f WHERE f.ino = c.ino)
+            ELSE EXISTS (SELECT 1 FROM ${this.tables.versions} v WHERE v.id = -c.ino)
+          END AS owned
+          FROM (SELECT DISTINCT ino FROM ${this.tables.chunks} WHERE ino > ? ORDER BY ino LIMIT ?) c`,
+          state.after,
+          FSCK_SLICE_SIZE
+        )
+        .toArray()
+      for (const row of rows) {
+        const ino = Number(row.ino)
+        if (!row.owned) {
+          report({ kind: 'orphanChunks', ino })
+          if (state.repair) sql.exec(`DELETE FROM ${this.tables.chunks} WHERE ino = ?`, ino)
+        }
+        state.after = ino
+      }
+      if (rows.length < FSCK_SLICE_SIZE) Object.assign(state, { phase: 'sizes', after: 0 })
+    } else if (state.phase === 'sizes') {
+      const rows = sql
+        .exec(
+          `SELECT ino, json_extract(attr, '$.size') AS size,
+            (SELECT COALESCE(SUM(length), 0) FROM ${this.tables.chunks} c WHERE c.ino = f.ino) AS actual
+          FROM ${this.tables.files} f WHERE ino > ? AND json_extract(attr, '$.kind') = 'File' ORDER BY ino LIMIT ?`,
+          state.after,
+          FSCK_SLICE_SIZE
+        )
+        .toArray()
+      for (const row of rows) {
+        const ino = Number(row.ino)
+        if (Number(row.size) !== Number(row.actual)) {
+          report({ kind: 'sizeMismatch', ino, expected: Number(row.actual), actual: Number(row.size) })
+          if (state.repair) {
+            sql.exec(
+              `UPDATE ${this.tables.files} SET attr = json_set(attr, '$.size', ?) WHERE ino = ?`,
+              Number(row.actual),
+              ino
+            )
+          }
+        }
+        state.after = ino
+      }
+      if (rows.length < FSCK_SLICE_SIZE) Object.assign(state, { phase: 'space', after: 0 })
+    } else {
+      const row = sql.exec(`SELECT COALESCE(SUM(length), 0) AS total FROM ${this.tables.chunks}`).next().value
+      const expected = Number(row?.total ?? 0)
+      const actual = this.getSpaceUsed()
+      if (expected !== actual) {
+        report({ kind: 'spaceUsedMismatch', expected, actual })
+        if (state.repair) this.setSpaceUsed(expected)
+      }
+      // A counter behind the highest inode, e.g. after editing the tables by hand, would hand out numbers that
+      // deleted files had. Moving it on starts a new generation so handles to those files read as stale.
+      const max = Number(sql.exec(`SELECT MAX(ino) AS max FROM ${this.tables.files}`).next().value?.max ?? 1)
+      const next = Number(sql.exec(`SELECT value FROM ${this.tables.meta} WHERE key = 'next_ino'`).next().value?.value)
+      if (!(next > max)) {
+        report({ kind: 'inodeCounter', expected: max + 1, actual: next })
+        if (state.repair) {
+          sql.exec(`UPDATE ${this.tables.meta} SET value = ? WHERE key = 'next_ino'`, String(max + 1))
+          sql.exec(
+            `UPDATE ${this.tables.meta} SET value = ? WHERE key = 'generation'`,
+            String(this.inodeGeneration() + 1)
+          )
+        }
+      }
+      state.done = true
+    }
+  }
+
+  // Walk up from an inode towards the root. Only the inode to blame is reported: the one whose
+  // parent is gone (or isn't a directory), or the lowest inode of a cycle
+  private fsckTreeProblem(ino: number): 'missingParent' | 'cycle' | undefined {
+    const seen = new Set<number>()
+    let current = ino
+    while (current !== 1) {
+      seen.add(current)
+      const row = this.sql.exec(`SELECT parent FROM ${this.tables.files} WHERE ino = ?`, current).next().value
+      if (!row) return undefined
+      if (row.parent == null) {
+        const trashed = this.sql.exec(`SELECT 1 FROM ${this.tables.trash} WHERE ino = ?`, current).next().value
+        return trashed || current !== ino ? undefined : 'missingParent'
+      }
+      const parent = this.sql.exec(`SELECT is_dir FROM ${this.tables.files} WHERE ino = ?`, row.parent).next().value
+      if (!parent || !parent.is_dir) return current === ino ? 'missingParent' : undefined
+      current = Number(row.parent)
+      if (current === ino) return Math.min(...seen) === ino ? 'cycle' : undefined
+      if (seen.has(current)) return undefined
+    }
+    return undefined
+  }
+
+  // Reattach an unreachable inode under /lost+found, named after its inode number like ext4 does
+  private moveToLostFound(ino: number) {
+    let row = this.sql
+      .exec(`SELECT ino FROM ${this.tables.files} WHERE parent = 1 AND name = 'lost+found'`)
+      .next().value
+    if (!row) {
+      this.mkdir('/lost+found', { mode: 0o700 })
+      row = { ino: this.resolvePathToInode('/lost+found') }
+    }
+    const lostFound = Number(row.ino)
+    const isDir = this.readAttr(ino).kind === 'Directory'
+    this.sql.exec(`UPDATE ${this.tables.files} SET parent = ?, name = ? WHERE ino = ?`, lostFound, `#${ino}`, ino)
+    this.touchDir(lostFound, isDir ? 1 : 0)
+  }
+
+  private useTrash(permanent?: boolean) {
+    return !!this.options.trash && !permanent
+  }
+
+  private trashRetention() {
+    const trash = this.options.trash
+    return typeof trash === 'object' ? trash.retentionMs : undefined
+  }
+
+  // Detach an inode (and its subtree) from the tree, keeping its data until the trash is purged
+  private moveToTrash(ino: number) {
+    const now = Date.now()
+    // Recorded from the tree rather than the caller's spelling, which may go through symlinks
+    const path = this.pathOfInode(ino)
+    this.sql.exec(`UPDATE ${this.tables.files} SET parent = NULL WHERE ino = ?`, ino)
+    this.sql.exec(
+      `INSERT INTO ${this.tables.trash} (ino, path, deleted_at, uid) VALUES (?, ?, ?, ?)`,
+      ino,
+      path,
+      now,
+      this.credentials.uid
+    )
+    this.touch(ino, { ctime: now })
+    const retention = this.trashRetention()
+    if (retention !== undefined) this.scheduleAlarm(now + retention)
+  }
+
+  // Check the caller could remove everything below a directory, as a recursive rmdir would
+  private checkRemoveTree(ino: number) {
+    if (this.credentials.uid === 0) return
+    const children = this.sql.exec(`SELECT ino, is_dir FROM ${this.tables.files} WHERE parent = ?`, ino).toArray()
+    for (const child of children) {
+      this.checkRemove(Number(child.ino))
+      if (child.is_dir) this.checkRemoveTree(Number(child.ino))
+    }
+  }
+
+  private purgeTrash(before: number, uid?: number) {
+    const rows = this.sql
+      .exec(
+        `SELECT id, ino FROM ${this.tables.trash} WHERE deleted_at < ? ${uid === undefined ? '' : 'AND uid = ?'}`,
+        before,
+        ...(uid === undefined ? [] : [uid])
+      )
+      .toArray()
+    for (const row of rows) {
+      this.removeTree(Number(row.ino))
+      this.sql.exec(`DELETE FROM ${this.tables.trash} WHERE id = ?`, row.id)
+    }
+    if (rows.length > 0) this.updateSpaceUsed()
+    return rows.length
+  }
+
+  // Set the Durable Object alarm for the earliest pending background work
+  private scheduleNextAlarm() {
+    const due: number[] = []
+    const retention = this.trashRetention()
+    if (retention !== undefined) {
+      const row = this.sql.exec(`SELECT MIN(deleted_at) AS at FROM ${this.tables.trash}`).next().value
+      if (row && row.at !== null) due.push(Number(row.at) + retention)
+    }
+    const maxAgeMs = this.versioning()?.maxAgeMs
+    if (maxAgeMs !== undefined) {
+      const row = this.sql.exec(`SELECT MIN(created_at) AS at FROM ${this.tables.versions}`).next().value
+      if (row && row.at !== null) due.push(Number(row.at) + maxAgeMs)
+    }
+    const expiry = this.sql
+      .exec(
+        `SELECT MIN(json_extract(attr, '$.expiresAt')) AS at FROM ${this.tables.files} WHERE json_extract(attr, '$.expiresAt') IS NOT NULL`
+      )
+      .next().value
+    if (expiry && expiry.at !== null) due.push(Number(expiry.at))
+    const fsck = this.readFsckState()
+    if (fsck && !fsck.done) due.push(Date.now())
+    const tiering = this.options.tiering
+    if (tiering) {
+      const orphan = this.sql.exec(`SELECT 1 FROM ${this.tables.tierOrphans} LIMIT 1`).next().value
+      due.push(orphan ? Date.now() : Date.now() + (tiering.intervalMs ?? DEFAULT_TIER_INTERVAL))
+    }
+    if (due.length > 0) this.scheduleAlarm(Math.min(...due))
+  }
+
+  // Make sure an alarm fires at or before `at`, without delaying one the host Durable Object set
+  private scheduleAlarm(at: number) {
+    scheduleAlarm(this.ctx.storage, at)
+  }
+
+  // Permanently delete an inode and everything stored for it
+  private removeInode(ino: number) {
+    this.sql.exec(`DELETE FROM ${this.tables.files} WHERE ino = ?`, ino)
+    this.sql.exec(`DELETE FROM ${this.tables.chunks} WHERE ino = ?`, ino)
+    this.sql.exec(
+      `DELETE FROM ${this.tables.chunks} WHERE ino IN (SELECT -id FROM ${this.tables.versions} WHERE ino = ?)`,
+      ino
+    )
+    this.sql.exec(`DELETE FROM ${this.tables.versions} WHERE ino = ?`, ino)
+    if (this.options.indexText) this.sql.exec(`DELETE FROM ${this.tables.text} WHERE rowid = ?`, ino)
+  }
+
+  // Permanently delete an inode and, for a directory, everything below it
+  private removeTree(ino: number) {
+    const inodes = this.sql
+      .exec(
+        `WITH RECURSIVE sub(ino) AS (
+          SELECT ?
+          UNION ALL
+          SELECT f.ino FROM ${this.tables.files} f JOIN sub ON f.parent = sub.ino
+        )
+        SELECT ino FROM sub`,
+        ino
+      )
+      .toArray()
+    for (const row of inodes) this.removeInode(Number(row.ino))
+  }
+
+  // Upload chunks of cold files and old versions to R2, leaving rows that only record the object key
+  private async tierChunks(limit: number) {
+    const tiering = this.options.tiering!
+    const bucket = this.tieringBucket()
+    const now = Date.now()
+    const minAgeMs = tiering.minAgeMs ?? DEFAULT_TIER_MIN_AGE
+    const rows = this.sql
+      .exec(
+        `SELECT ino, offset, data, checksum FROM ${this.tables.chunks}
+          WHERE location IS NULL AND length > 0 AND (
+            ino IN (
+              SELECT ino FROM ${this.tables.files}
+              WHERE is_dir = 0
+                AND json_extract(attr, '$.size') >= ?
+                AND json_extract(attr, '$.mtime') <= ?
+                AND json_extract(attr, '$.atime') <= ?
+            )
+            OR ino IN (SELECT -id FROM ${this.tables.versions} WHERE created_at <= ?)
+          )
+          LIMIT ?`,
+        tiering.minSize ?? DEFAULT_TIER_MIN_SIZE,
+        now - minAgeMs,
+        now - (tiering.idleMs ?? minAgeMs),
+        now - minAgeMs,
+        limit
+      )
+      .toArray()
+    let moved = 0
+    for (const row of rows) {
+      const data = new Uint8Array(row.data as ArrayBuffer)
+      const key = `${tiering.prefix ?? 'dofs/'}${this.ctx.id.toString()}/${crypto.randomUUID()}`
+      await bucket.put(key, data)
+      // The chunk may have been rewritten during the upload, in which case the object is cleaned up instead
+      const updated = this.sql
+        .exec(
+          `UPDATE ${this.tables.chunks} SET data = zeroblob(0), location = ?, checksum = COALESCE(checksum, ?) WHERE ino = ? AND offset = ? AND location IS NULL AND data = ? RETURNING ino`,
+          key,
+          this.checksum(data),
+          row.ino,
+          row.offset,
+          data
+        )
+        .toArray()
+      if (updated.length > 0) moved++
+      else this.sql.exec(`INSERT OR IGNORE INTO ${this.tables.tierOrphans} (key) VALUES (?)`, key)
+    }
+    return moved
+  }
+
+  // Delete R2 objects that no chunk refers to any more. Copies share objects, so one is only deleted
+  // once the last chunk referring to it is gone.
+  private async deleteOrphanedObjects() {
+    this.sql.exec(
+      `DELETE FROM ${this.tables.tierOrphans} WHERE EXISTS (SELECT 1 FROM ${this.tables.chunks} WHERE location = ${this.tables.tierOrphans}.key)`
+    )
+    const keys = this.sql
+      .exec(`SELECT key FROM ${this.tables.tierOrphans} LIMIT ?`, TIER_BATCH_SIZE)
+      .toArray()
+      .map((row) => String(row.key))
+    if (keys.length === 0) return
+    await this.tieringBucket().delete(keys)
+    this.sql.exec(`DELETE FROM ${this.tables.tierOrphans} WHERE key IN (${keys.map(() => '?').join(', ')})`, ...keys)
+  }
+
+  // Move chunks back from R2 into SQLite, either the given offsets or all of them. Returns undefined when
+  // none are tiered, so callers can stay synchronous.
+  private recallChunks(ino: number, offsets?: number[]): Promise<void> | undefined {
+    const rows = offsets
+      ? this.sql
+          .exec(
+            `SELECT offset, location FROM ${this.tables.chunks} WHERE ino = ? AND location IS NOT NULL AND offset IN (${offsets.map(() => '?').join(', ')})`,
+            ino,
+            ...offsets
+          )
+          .toArray()
+      : this.sql
+          .exec(`SELECT offset, location FROM ${this.tables.chunks} WHERE ino = ? AND location IS NOT NULL`, ino)
+          .toArray()
+    if (rows.length === 0) return undefined
+    return (async () => {
+      for (const row of rows) {
+        const data = await this.fetchChunk(String(row.location))
+        this.sql.exec(
+          `UPDATE ${this.tables.chunks} SET data = ?, location = NULL WHERE ino = ? AND offset = ? AND location = ?`,
+          data,
+          ino,
+          row.offset,
+          row.location
+        )
+      }
+    })()
+  }
+
+  private hasTieredChunks(ino: number) {
+    return !!this.sql
+      .exec(`SELECT 1 FROM ${this.tables.chunks} WHERE ino = ? AND location IS NOT NULL LIMIT 1`, ino)
+      .next().value
+  }
+
+  private async fetchChunk(key: string) {
+    const object = await this.tieringBucket().get(key)
+    if (!object) throw new FsError('EIO')
+    return new Uint8Array(await object.arrayBuffer())
+  }
+
+  private tieringBucket(): R2Bucket {
+    const bucket = this.options.tiering?.bucket
+    const resolved = typeof bucket === 'string' ? (this.env as unknown as Record<string, R2Bucket>)[bucket] : bucket
+    // Chunks already in R2 can't be read once tiering is turned off
+    if (!resolved) throw new FsError('EIO')
+    return resolved
+  }
+
+  // Absolute path of an inode, or undefined if it isn't reachable from the root
+  private pathOfInode(ino: number): string | undefined {
+    if (ino === 1) return '/'
+    const rows = this.sql
+      .exec(
+        `WITH RECURSIVE up(ino, parent, name, depth) AS (
+          SELECT ino, parent, name, 0 FROM ${this.tables.files} WHERE ino = ?
+          UNION ALL
+          SELECT f.ino, f.parent, f.name, up.depth + 1 FROM ${this.tables.files} f JOIN up ON f.ino = up.parent
+          WHERE up.depth < 4096
+        )
+        SELECT ino, name FROM up ORDER BY depth DESC`,
+        ino
+      )
+      .toArray()
+    if (rows.length === 0 || Number(rows[0].ino) !== 1) return undefined
+    return '/' + rows
+      .slice(1)
+      .map((row) => row.name)
+      .join('/')
+  }
+
+  // Concatenate a file's chunks
+  private readAllChunks(ino: number, size: number) {
+    const result = new Uint8Array(size)
+    const cursor = this.sql.exec(`SELECT offset, data FROM ${this.tables.chunks} WHERE ino = ? ORDER BY offset`, ino)
+    for (const row of cursor) {
+      const data = row.data instanceof ArrayBuffer ? new Uint8Array(row.data) : (row.data as Uint8Array)
+      const offset = Number(row.offset)
+      if (offset < size) result.set(data.subarray(0, size - offset), offset)
+    }
+    return result
+  }
+
+  // Refresh what is derived from a file's content after it changes
+  private reindex(ino: number) {
+    this.updateContentType(ino)
+    this.updateDigest(ino)
+    this.updateTextIndex(ino)
+  }
+
+  private setContentType(ino: number, contentType: string | undefined) {
+    if (contentType === undefined) {
+      this.sql.exec(`UPDATE ${this.tables.files} SET attr = json_remove(attr, '$.contentType') WHERE ino = ?`, ino)
+    } else {
+      this.sql.exec(
+        `UPDATE ${this.tables.files} SET attr = json_set(attr, '$.contentType', ?) WHERE ino = ?`,
+        contentType,
+        ino
+      )
+    }
+  }
+
+  // Detect a file's content type once it has data, from its name and first chunk; a type already set is kept
+  private updateContentType(ino: number) {
+    const row = this.sql.exec(`SELECT name, attr FROM ${this.tables.files} WHERE ino = ?`, ino).next().value
+    if (!row) return
+    const attr = this.parseAttr(row.attr)
+    if (attr.kind !== 'File' || attr.contentType || !attr.size) return
+    const chunk = this.sql
+      .exec(`SELECT data, location FROM ${this.tables.chunks} WHERE ino = ? AND offset = 0`, ino)
+      .next().value
+    // A first chunk in R2 can't be read synchronously, leaving just the extension to go by
+    const head = chunk && chunk.location == null ? new Uint8Array(chunk.data as ArrayBuffer) : undefined
+    this.setContentType(ino, detectContentType(String(row.name), head))
+  }
+
+  private checksum(data: Uint8Array) {
+    const checksums = this.options.checksums
+    if (!checksums) return null
+    return (checksums === true ? sha256 : (checksums.hash ?? sha256))(data)
+  }
+
+  // The digest hashes the chunk checksums in order, so it doesn't need to re-read file data.
+  // Chunks written before checksums were enabled get their checksum here.
+  private updateDigest(ino: number) {
+    if (!this.options.checksums) return
+    const rows = this.sql
+      .exec(
+        `SELECT offset, checksum, CASE WHEN checksum IS NULL THEN data END AS data FROM ${this.tables.chunks} WHERE ino = ? ORDER BY offset`,
+        ino
+      )
+      .toArray()
+    const checksums = rows.map((row) => {
+      if (row.checksum != null) return String(row.checksum)
+      const checksum = this.checksum(new Uint8Array(row.data as ArrayBuffer))!
+      this.sql.exec(
+        `UPDATE ${this.tables.chunks} SET checksum = ? WHERE ino = ? AND offset = ?`,
+        checksum,
+        ino,
+        row.offset
+      )
+      return checksum
+    })
+    const digest = this.checksum(new TextEncoder().encode(checksums.join('\n')))
+    this.sql.exec(`UPDATE ${this.tables.files} SET attr = json_set(attr, '$.digest', ?) WHERE ino = ?`, digest, ino)
+  }
+
+  // Refresh a file's row in the text index; binary and oversized files are left out
+  private updateTextIndex(ino: number) {
+    if (!this.options.indexText) return
+    // Files partly in R2 can't be read synchronously, so they keep their current entry
+    if (this.hasTieredChunks(ino)) return
+    this.sql.exec(`DELETE FROM ${this.tables.text} WHERE rowid = ?`, ino)
+    const attr = this.readAttr(ino)
+    if (attr.kind !== 'File' || !attr.size || attr.size > TEXT_INDEX_MAX_SIZE) return
+    const bytes = this.readAllChunks(ino, attr.size)
+    if (bytes.includes(0)) return
+    let content: string
+    try {
+      content = new TextDecoder('utf-8', { fatal: true }).decode(bytes)
+    } catch {
+      return
+    }
+    this.sql.exec(`INSERT INTO ${this.tables.text} (rowid, content) VALUES (?, ?)`, ino, content)
+  }
 }
@@ -0,0 +1,106 @@
+// POSIX errno values and Node-style descriptions for the codes dofs raises
+const errors = {
+  EPERM: [1, 'operation not permitted'],
+  ENOENT: [2, 'no such file or directory'],
+  EIO: [5, 'i/o error'],
+  ENXIO: [6, 'no such device or address'],
+  EBADF: [9, 'bad file descriptor'],
+  EACCES: [13, 'permission denied'],
+  EBUSY: [16, 'resource busy or locked'],
+  EEXIST: [17, 'file already exists'],
+  EXDEV: [18, 'cross-device link not permitted'],
+  ENOTDIR: [20, 'not a directory'],
+  EISDIR: [21, 'illegal operation on a directory'],
+  EINVAL: [22, 'invalid argument'],
+  EFBIG: [27, 'file too large'],
+  ENOSPC: [28, 'no space left on device'],
+  ENAMETOOLONG: [36, 'name too long'],
+  ENOTEMPTY: [39, 'directory not empty'],
+  ELOOP: [40, 'too many symbolic links encountered'],
+  ENOTSUP: [95, 'operation not supported'],
+  ESTALE: [116, 'stale file handle'],
+} as const satisfies Record<string, readonly [number, string]>
+
+export type FsErrorCode = keyof typeof errors
+
+export type FsErrorJSON = {
+  name: 'FsError'
+  code: FsErrorCode
+  errno: number
+  syscall?: string
+  path?: string
+  dest?: string
+  message: string
+}
+
+// Matches messages like "ENOENT: no such file or directory, open '/a' -> '/b'"
+const MESSAGE_PATTERN = /^(E[A-Z]+): [^,]*(?:, (\w+)(?: '(.*?)'(?: -> '(.*)')?)?)?$/
+
+/**
+ * Error thrown by every Fs method. The message uses Node's format so the code, syscall and
+ * path survive RPC, which only preserves an error's message; use FsError.from() to recover them.
+ */
+export class FsError extends Error {
+  readonly code: FsErrorCode
+  /** Positive POSIX errno, as used by FUSE */
+  readonly errno: number
+  syscall?: string
+  path?: string
+  dest?: string
+
+  constructor(code: FsErrorCode, syscall?: string, path?: string, dest?: string) {
+    super(code)
+    this.name = 'FsError'
+    this.code = code
+    this.errno = errors[code][0]
+    this.syscall = syscall
+    this.path = path
+    this.dest = dest
+    this.message = this.format()
+  }
+
+  // Fill in the syscall and paths if the code that threw didn't know them
+  withContext(syscall: string, path?: string, dest?: string) {
+    if (this.syscall) return this
+    this.syscall = syscall
+    this.path = path
+    this.dest = dest
+    this.message = this.format()
+    return this
+  }
+
+  toJSON(): FsErrorJSON {
+    return {
+      name: 'FsError',
+      code: this.code,
+      errno: this.errno,
+      syscall: this.syscall,
+      path: this.path,
+      dest: this.dest,
+      message: this.message,
+    }
+  }
+
+  // Recover an FsError from a thrown value, including errors that crossed RPC or were serialized to JSON
+  static from(e: unknown): FsError | undefined {
+    if (e instanceof FsError) return e
+    if (!e || typeof e !== 'object') return undefined
+    const { code, syscall, path, dest, message } = e as Partial<FsErrorJSON>
+    // Own keys only, so names inherited from Object.prototype like 'toString' aren't taken for codes
+    if (typeof code === 'string' && Object.hasOwn(errors, code)) return new FsError(code, syscall, path, dest)
+    const match = typeof message === 'string' ? MESSAGE_PATTERN.exec(message) : null
+    if (!match || !Object.hasOwn(errors, match[1])) return undefined
+    return new FsError(match[1] as FsErrorCode, match[2], match[3], match[4])
+  }
+
+  private format() {
+    let message = `${this.code}: ${errors[this.code][1]}`
+    if (this.syscall) message += `, ${this.syscall}`
+    if (this.path !== undefined) message += ` '${this.path}'`
+    if (this.dest !== undefined) message += ` -> '${this.dest}'`
+    return message
+  }
+}
+
+export const isFsError = (e: unknown, code?: FsErrorCode): e is FsError =>
+  e instanceof FsError && (code === undefined || e.code === code)
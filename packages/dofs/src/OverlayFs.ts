@@ -0,0 +1,295 @@
+import { RpcTarget } from 'cloudflare:workers'
+import {
+  Fs,
+  MkdirOptions,
+  MknodOptions,
+  ReadFileOptions,
+  ReadOptions,
+  RmdirOptions,
+  SetAttrOptions,
+  WriteFileOptions,
+  WriteOptions,
+} from './Fs.js'
+import { FsError } from './FsError.js'
+import { collapsePath, joinPath, splitPath as splitLayerPath } from './path.js'
+
+// An upper-layer file named .wh.<name> hides the lower entry <name> (AUFS-style whiteout)
+const WHITEOUT_PREFIX = '.wh.'
+// An upper-layer directory containing this file hides everything below it in the lower layer
+const OPAQUE_MARKER = '.wh..wh..opq'
+
+// Entries are matched across layers by path, so '..' is taken textually rather than after symlinks in one layer
+const splitPath = (path: string) => splitLayerPath(collapsePath(path))
+
+// Names starting with the whiteout prefix belong to the overlay, so user entries can't have them
+const isReserved = (path: string) => splitPath(path).name?.startsWith(WHITEOUT_PREFIX) ?? false
+
+const whiteoutOf = (path: string) => {
+  const { parent, name } = splitPath(path)
+  return joinPath(parent, WHITEOUT_PREFIX + name)
+}
+
+const isMissing = (e: unknown) => {
+  const code = FsError.from(e)?.code
+  return code === 'ENOENT' || code === 'ENOTDIR'
+}
+
+/**
+ * Merges a read-only lower filesystem, such as a template shared by many Durable Objects, with a writable
+ * upper one. Reads fall through to the lower layer until an entry is changed: the first write copies it up,
+ * and deleting a lower entry leaves a whiteout in the upper layer. The lower layer is never written.
+ */
+export class OverlayFs extends RpcTarget {
+  private lower: Fs
+  private upper: Fs
+
+  constructor(lower: Fs | Rpc.Stub<Fs>, upper: Fs | Rpc.Stub<Fs>) {
+    super()
+    // Direct calls return values and stub calls return promises; awaiting handles both
+    this.lower = lower as Fs
+    this.upper = upper as Fs
+  }
+
+  public async readFile(path: string, options?: ReadFileOptions) {
+    return (await this.layerOf(path, 'open')).readFile(path, options)
+  }
+
+  public async read(path: string, options: ReadOptions) {
+    return (await this.layerOf(path, 'read')).read(path, options)
+  }
+
+  public async stat(path: string) {
+    return (await this.layerOf(path, 'stat')).stat(path)
+  }
+
+  public async lstat(path: string) {
+    return (await this.layerOf(path, 'lstat')).lstat(path)
+  }
+
+  public async readlink(path: string) {
+    return (await this.layerOf(path, 'readlink')).readlink(path)
+  }
+
+  public async exists(path: string) {
+    if (isReserved(path)) return false
+    return (await this.existsIn(this.upper, path)) || (await this.visibleInLower(path))
+  }
+
+  // Upper entries plus the lower entries that aren't whited out, hiding the overlay's own markers
+  public async listDir(path: string) {
+    if (isReserved(path)) throw new FsError('ENOENT', 'scandir', path)
+    const names = new Set<string>()
+    const whiteouts = new Set<string>()
+    let found = false
+    let opaque = false
+    if (await this.existsIn(this.upper, path)) {
+      found = true
+      for (const name of await this.upper.listDir(path)) {
+        if (name === OPAQUE_MARKER) opaque = true
+        else if (name.startsWith(WHITEOUT_PREFIX)) whiteouts.add(name.slice(WHITEOUT_PREFIX.length))
+        else names.add(name)
+      }
+    }
+    if (!opaque && !(await this.isHidden(path))) {
+      try {
+        for (const name of await this.lower.listDir(path)) {
+          if (!whiteouts.has(name)) names.add(name)
+        }
+        found = true
+      } catch (e) {
+        if (!isMissing(e)) throw e
+      }
+    }
+    if (!found) throw new FsError('ENOENT', 'scandir', path)
+    return [...names]
+  }
+
+  public async writeFile(
+    path: string,
+    data: ArrayBuffer | string | ReadableStream<Uint8Array>,
+    options?: WriteFileOptions
+  ) {
+    await this.prepareUpper(path, 'open')
+    return this.upper.writeFile(path, data, options)
+  }
+
+  public async write(path: string, data: ArrayBuffer | string, options: WriteOptions) {
+    if (await this.exists(path)) await this.copyUp(path, 'write')
+    else await this.prepareUpper(path, 'write')
+    return this.upper.write(path, data, options)
+  }
+
+  public async truncate(path: string, size: number) {
+    await this.copyUp(path, 'truncate')
+    return this.upper.truncate(path, size)
+  }
+
+  public async setattr(path: string, options: SetAttrOptions) {
+    await this.copyUp(path, 'setattr')
+    return this.upper.setattr(path, options)
+  }
+
+  public async utimes(path: string, atime: number | Date, mtime: number | Date) {
+    await this.copyUp(path, 'utime')
+    return this.upper.utimes(path, atime, mtime)
+  }
+
+  public async mkdir(path: string, options?: MkdirOptions) {
+    if (await this.exists(path)) {
+      if (options?.recursive) return
+      throw new FsError('EEXIST', 'mkdir', path)
+    }
+    const { parent } = splitPath(path)
+    if (!(await this.exists(parent))) {
+      if (!options?.recursive) throw new FsError('ENOENT', 'mkdir', path)
+      await this.mkdir(parent, options)
+    }
+    await this.prepareUpper(path, 'mkdir')
+    await this.upper.mkdir(path, { mode: options?.mode, umask: options?.umask })
+    // A new directory replacing a deleted lower one must not show the old contents
+    if (await this.existsIn(this.lower, path)) await this.upper.writeFile(joinPath(path, OPAQUE_MARKER), '')
+  }
+
+  public async symlink(target: string, path: string) {
+    if (await this.exists(path)) throw new FsError('EEXIST', 'symlink', target, path)
+    await this.prepareUpper(path, 'symlink')
+    return this.upper.symlink(target, path)
+  }
+
+  public async mknod(path: string, options: MknodOptions) {
+    if (await this.exists(path)) throw new FsError('EEXIST', 'mknod', path)
+    await this.prepareUpper(path, 'mknod')
+    return this.upper.mknod(path, options)
+  }
+
+  public async unlink(path: string) {
+    if (isReserved(path)) throw new FsError('ENOENT', 'unlink', path)
+    const inUpper = await this.existsIn(this.upper, path)
+    const inLower = await this.visibleInLower(path)
+    if (!inUpper && !inLower) throw new FsError('ENOENT', 'unlink', path)
+    if (inUpper) await this.upper.unlink(path)
+    else if ((await this.lower.lstat(path)).isDirectory) throw new FsError('EISDIR', 'unlink', path)
+    if (inLower) await this.whiteout(path, 'unlink')
+  }
+
+  public async rmdir(path: string, options?: RmdirOptions) {
+    const entries = (await this.listDir(path)).filter((name) => name !== '.' && name !== '..')
+    if (entries.length > 0 && !options?.recursive) throw new FsError('ENOTEMPTY', 'rmdir', path)
+    const inUpper = await this.existsIn(this.upper, path)
+    const inLower = await this.visibleInLower(path)
+    // The upper directory may still hold whiteouts even when the merged view is empty
+    if (inUpper) await this.upper.rmdir(path, { recursive: true })
+    if (inLower) await this.whiteout(path, 'rmdir')
+  }
+
+  // Like overlayfs without redirect_dir, directories that exist in the lower layer can't be renamed (EXDEV)
+  public async rename(oldPath: string, newPath: string) {
+    const inLower = await this.visibleInLower(oldPath)
+    const stat = await this.lstat(oldPath)
+    if (stat.isDirectory && inLower) throw new FsError('EXDEV', 'rename', oldPath, newPath)
+    const [from, to] = [collapsePath(oldPath), collapsePath(newPath)]
+    if (from === to) return
+    // Checked before the destination is cleared below, rather than left to the upper rename
+    if (to.startsWith(from + '/')) throw new FsError('EINVAL', 'rename', oldPath, newPath)
+    // The destination may only exist in the lower layer, where the upper rename can't check it
+    if (await this.exists(newPath)) {
+      const destStat = await this.lstat(newPath)
+      if (destStat.isDirectory && !stat.isDirectory) throw new FsError('EISDIR', 'rename', oldPath, newPath)
+      if (!destStat.isDirectory && stat.isDirectory) throw new FsError('ENOTDIR', 'rename', oldPath, newPath)
+      if (destStat.isDirectory) {
+        const entries = (await this.listDir(newPath)).filter((name) => name !== '.' && name !== '..')
+        if (entries.length > 0) throw new FsError('ENOTEMPTY', 'rename', oldPath, newPath)
+        await this.rmdir(newPath)
+      }
+    }
+    await this.copyUp(oldPath, 'rename')
+    await this.prepareUpper(newPath, 'rename')
+    await this.upper.rename(oldPath, newPath)
+    if (inLower) await this.whiteout(oldPath, 'rename')
+    // As with mkdir, a directory moved over a lower one must not show its contents
+    if (stat.isDirectory && (await this.existsIn(this.lower, newPath))) {
+      await this.upper.writeFile(joinPath(newPath, OPAQUE_MARKER), '')
+    }
+  }
+
+  // The layer that provides path: the upper one if it has the entry, otherwise the lower one unless it's hidden
+  private async layerOf(path: string, syscall: string): Promise<Fs> {
+    if (isReserved(path)) throw new FsError('ENOENT', syscall, path)
+    if (await this.existsIn(this.upper, path)) return this.upper
+    if (await this.isHidden(path)) throw new FsError('ENOENT', syscall, path)
+    return this.lower
+  }
+
+  // A dangling symlink still counts as an entry
+  private async existsIn(layer: Fs, path: string) {
+    try {
+      await layer.lstat(path)
+      return true
+    } catch (e) {
+      if (isMissing(e)) return false
+      throw e
+    }
+  }
+
+  private async visibleInLower(path: string) {
+    return !(await this.isHidden(path)) && (await this.existsIn(this.lower, path))
+  }
+
+  // Whether a whiteout or opaque directory in the upper layer hides path, or one of its ancestors, in the lower layer
+  private async isHidden(path: string) {
+    const { parts } = splitPath(path)
+    for (let i = 0; i < parts.length; i++) {
+      const dir = '/' + parts.slice(0, i).join('/')
+      if (await this.existsIn(this.upper, joinPath(dir, WHITEOUT_PREFIX + parts[i]))) return true
+      if (await this.existsIn(this.upper, joinPath(dir, OPAQUE_MARKER))) return true
+    }
+    return false
+  }
+
+  // Copy path and any missing ancestors from the lower layer into the upper one, keeping modes and times
+  private async copyUp(path: string, syscall: string) {
+    if (isReserved(path)) throw new FsError('ENOENT', syscall, path)
+    const { parts } = splitPath(path)
+    for (let i = 1; i <= parts.length; i++) {
+      const current = '/' + parts.slice(0, i).join('/')
+      if (await this.existsIn(this.upper, current)) continue
+      if (await this.isHidden(current)) throw new FsError('ENOENT', syscall, path)
+      let stat
+      try {
+        stat = await this.lower.lstat(current)
+      } catch (e) {
+        if (isMissing(e)) throw new FsError('ENOENT', syscall, path)
+        throw e
+      }
+      if (stat.kind === 'Directory') {
+        await this.upper.mkdir(current, { mode: stat.mode })
+      } else if (stat.kind === 'Symlink') {
+        await this.upper.symlink(await this.lower.readlink(current), current)
+      } else if (stat.kind !== 'File') {
+        await this.upper.mknod(current, { kind: stat.kind as MknodOptions['kind'], mode: stat.mode, rdev: stat.rdev })
+      } else {
+        await this.upper.writeFile(current, await this.lower.readFile(current))
+        await this.upper.setattr(current, { mode: stat.mode })
+      }
+      await this.upper.utimes(current, stat.atime ?? Date.now(), stat.mtime ?? Date.now(), {
+        followSymlinks: false,
+      })
+    }
+  }
+
+  // Make path's parent exist in the upper layer and clear any whiteout for path, ready to create it
+  private async prepareUpper(path: string, syscall: string) {
+    if (isReserved(path)) throw new FsError('EINVAL', syscall, path)
+    await this.copyUp(splitPath(path).parent, syscall)
+    try {
+      await this.upper.unlink(whiteoutOf(path), { permanent: true })
+    } catch (e) {
+      if (!isMissing(e)) throw e
+    }
+  }
+
+  private async whiteout(path: string, syscall: string) {
+    await this.copyUp(splitPath(path).parent, syscall)
+    await this.upper.writeFile(whiteoutOf(path), '')
+  }
+}
@@ -0,0 +1,68 @@
+// A Durable Object has a single alarm, shared by dofs' background work and the host's own alarm() handler. The
+// dofs_alarm table, shared by all volumes, keeps when each of them is due so neither pushes the other back.
+const DOFS = 1 // When dofs' background work is next due
+const HOST = 2 // The host's own alarm, which dofs moved earlier
+const SET = 3 // What dofs last set the Durable Object alarm to
+
+export const ensureAlarmTable = (storage: DurableObjectStorage) => {
+  storage.sql.exec('CREATE TABLE IF NOT EXISTS dofs_alarm (id INTEGER PRIMARY KEY, at INTEGER NOT NULL)')
+  // Before SET was kept, the alarm was always dofs' own pending time
+  storage.sql.exec(`INSERT OR IGNORE INTO dofs_alarm (id, at) SELECT ${SET}, at FROM dofs_alarm WHERE id = ${DOFS}`)
+}
+
+const readAlarms = (storage: DurableObjectStorage) => {
+  const rows = storage.sql.exec<{ id: number; at: number }>('SELECT id, at FROM dofs_alarm').toArray()
+  return new Map(rows.map((row) => [Number(row.id), Number(row.at)]))
+}
+
+const saveAlarm = (storage: DurableObjectStorage, id: number, at: number) => {
+  storage.sql.exec('INSERT OR REPLACE INTO dofs_alarm (id, at) VALUES (?, ?)', id, at)
+}
+
+// Set the Durable Object alarm to the earliest of dofs' and the host's
+const setEarliest = (storage: DurableObjectStorage, existing: number | null, host?: number) => {
+  const alarms = readAlarms(storage)
+  // An alarm dofs didn't set is the host's, set before dofs scheduled anything or with setAlarm() directly
+  if (host === undefined && existing !== null && existing !== alarms.get(SET)) host = existing
+  if (host !== undefined) {
+    saveAlarm(storage, HOST, host)
+    alarms.set(HOST, host)
+  }
+  const due = [alarms.get(DOFS), alarms.get(HOST)].filter((at): at is number => at !== undefined)
+  if (due.length === 0) return
+  const at = Math.min(...due)
+  saveAlarm(storage, SET, at)
+  if (at !== existing) storage.setAlarm(at)
+}
+
+// Make sure an alarm fires at or before `at` for dofs' background work. The pending time is kept in SQL so calls
+// made while getAlarm() is in flight don't schedule twice.
+export const scheduleAlarm = (storage: DurableObjectStorage, at: number) => {
+  const pending = readAlarms(storage).get(DOFS)
+  if (pending !== undefined && pending <= at && pending > Date.now()) return
+  saveAlarm(storage, DOFS, at)
+  void storage.getAlarm().then((existing) => setEarliest(storage, existing))
+}
+
+// Schedule the host's own alarm without displacing dofs'. Use it instead of storage.setAlarm() in a Durable Object
+// that also runs dofs.
+export const setHostAlarm = async (storage: DurableObjectStorage, at: number | Date) => {
+  setEarliest(storage, await storage.getAlarm(), Number(at))
+}
+
+// Call at the start of alarm(), before fs.alarm() reschedules. Returns whether the host's own alarm was due, i.e.
+// whether the host's alarm work should run, rather than the alarm firing only for dofs.
+export const claimAlarm = (storage: DurableObjectStorage) => {
+  const now = Date.now()
+  const alarms = readAlarms(storage)
+  const dofs = alarms.get(DOFS)
+  const host = alarms.get(HOST)
+  storage.sql.exec('DELETE FROM dofs_alarm WHERE at <= ?', now)
+  // The host's alarm, if still pending, has to be set again now that this one has fired
+  if (host !== undefined && host > now) {
+    saveAlarm(storage, SET, host)
+    storage.setAlarm(host)
+  }
+  // An alarm dofs wasn't due for was set by the host directly
+  return (host !== undefined && host <= now) || dofs === undefined || dofs > now
+}
@@ -32,4 +32,25 @@ program
     // TODO: Implement status command
   })
 
-program.parse()
+program
+  .command('du')
+  .description('Show disk usage per directory of a DOFS filesystem served by the dofs Hono routes')
+  .argument('[path]', 'Directory to summarize', '/')
+  .requiredOption('-u, --url <url>', 'Base URL of the filesystem routes, e.g. https://example.com/api/dofs/MY_DO/my-id')
+  .option('-d, --max-depth <depth>', 'Report directories up to this depth')
+  .action(async (path: string, options: { url: string; maxDepth?: string }) => {
+    const url = new URL(options.url.replace(/\/?$/, '/du'))
+    url.searchParams.set('path', path)
+    if (options.maxDepth !== undefined) url.searchParams.set('maxDepth', options.maxDepth)
+    const res = await fetch(url)
+    if (!res.ok) {
+      console.error(`du failed: ${res.status} ${await res.text()}`)
+      process.exit(1)
+    }
+    const entries: { path: string; bytes: number; inodes: number }[] = await res.json()
+    for (const { path, bytes, inodes } of entries) {
+      console.log(`${String(bytes).padStart(12)}  ${String(inodes).padStart(8)}  ${path}`)
+    }
+  })
+
+program.parseAsync()
@@ -0,0 +1,14 @@
+// Opaque pagination cursors: base64-encoded JSON, so callers can't depend on their contents
+
+export const encodeCursor = (value: unknown) => {
+  const bytes = new TextEncoder().encode(JSON.stringify(value))
+  let binary = ''
+  for (const byte of bytes) binary += String.fromCharCode(byte)
+  return btoa(binary)
+}
+
+export const decodeCursor = <T>(cursor: string): T => {
+  const binary = atob(cursor)
+  const bytes = Uint8Array.from(binary, (c) => c.charCodeAt(0))
+  return JSON.parse(new TextDecoder().decode(bytes))
+}
@@ -0,0 +1,69 @@
+// Glob pattern helpers for Fs.glob(). Supports *, ?, [...], [!...], {a,b} and ** (any number of directories).
+
+const MAGIC = /[*?[{]/
+
+export const hasMagic = (segment: string) => MAGIC.test(segment)
+
+// Split an absolute pattern into the literal directory it starts from and the segments to match below it
+export const splitGlob = (pattern: string) => {
+  const parts = pattern.split('/').filter(Boolean)
+  const firstMagic = parts.findIndex(hasMagic)
+  const literal = firstMagic === -1 ? parts.length : firstMagic
+  return {
+    base: '/' + parts.slice(0, literal).join('/'),
+    segments: parts.slice(literal),
+  }
+}
+
+// Translate a single name segment into a SQLite GLOB, or undefined if GLOB can't express it
+export const toSqlGlob = (segment: string) => {
+  if (segment.includes('{') || segment.includes('**')) return undefined
+  return segment.replace(/\[!/g, '[^')
+}
+
+const segmentSource = (segment: string) => {
+  let source = ''
+  for (let i = 0; i < segment.length; i++) {
+    const c = segment[i]
+    if (c === '*') {
+      source += '[^/]*'
+    } else if (c === '?') {
+      source += '[^/]'
+    } else if (c === '[') {
+      const end = segment.indexOf(']', i + 2)
+      if (end === -1) {
+        source += '\\['
+        continue
+      }
+      let body = segment.slice(i + 1, end).replace(/\\/g, '\\\\')
+      if (body.startsWith('!')) body = '^' + body.slice(1)
+      source += `[${body}]`
+      i = end
+    } else if (c === '{') {
+      const end = segment.indexOf('}', i)
+      if (end === -1) {
+        source += '\\{'
+        continue
+      }
+      const options = segment.slice(i + 1, end).split(',')
+      source += `(?:${options.map(segmentSource).join('|')})`
+      i = end
+    } else {
+      source += c.replace(/[.+^$()|\\\]}]/g, '\\$&')
+    }
+  }
+  return source
+}
+
+// Build a RegExp matching full paths under base against the remaining pattern segments
+export const globToRegExp = (base: string, segments: string[]) => {
+  let source = base === '/' ? '' : segmentSource(base)
+  for (const segment of segments) {
+    if (segment === '**') {
+      source += '(?:/[^/]+)*'
+    } else {
+      source += '/' + segmentSource(segment)
+    }
+  }
+  return new RegExp(`^${source}$`)
+}
@@ -8,14 +8,14 @@ export * from './types.js'
 export const dofs = <TEnv extends Cloudflare.Env>(config: DurableObjectConfig<TEnv>) => {
   const api = new Hono<{ Bindings: TEnv } & DofsContext>()
 
-  const getFs = async (doNamespace: string, doName: string, env: TEnv) => {
+  const getFs = async (doNamespace: string, doName: string, env: TEnv, volume?: string) => {
     if (!(doNamespace in env)) {
       throw new Error(`Durable Object namespace ${doNamespace} not found`)
     }
     const ns = env[doNamespace as keyof TEnv] as DurableObjectNamespace<WithDofs<TEnv>>
     const doId = ns.idFromName(doName)
     const stub = ns.get(doId)
-    return stub.getFs()
+    return stub.getFs(volume)
   }
 
   // Create filesystem routes
@@ -25,7 +25,11 @@ export const dofs = <TEnv extends Cloudflare.Env>(config: DurableObjectConfig<TE
   api.use('/:doNamespace/:doId/*', async (c, next) => {
     const { doNamespace, doId } = c.req.param()
     try {
-      const fs = await getFs(doNamespace, doId, c.env)
+      // ?volume= selects one of the named volumes configured with withDofs/@Dofs
+      let fs = await getFs(doNamespace, doId, c.env, c.req.query('volume'))
+      // The actor is set while the stub is still root, since only root can set it
+      if (config.resolveActor) fs = await fs.withContext({ actor: await config.resolveActor(c) })
+      if (config.resolveCredentials) fs = await fs.withCredentials(await config.resolveCredentials(c))
       c.set('fs', fs)
       await next()
     } catch (error) {
@@ -1,6 +1,28 @@
-import { Hono } from 'hono'
+import { Context, Hono } from 'hono'
+import { ContentfulStatusCode } from 'hono/utils/http-status'
+import { FsError, FsErrorCode } from '../FsError.js'
+import { toPrometheus } from '../metrics.js'
+import { typeForPath } from '../mime.js'
 import { DofsContext } from './types.js'
 
+const errorStatus: Partial<Record<FsErrorCode, ContentfulStatusCode>> = {
+  ENOENT: 404,
+  EACCES: 403,
+  EPERM: 403,
+  EEXIST: 409,
+  ENOTEMPTY: 409,
+  EBUSY: 409,
+  ENOSPC: 507,
+  EIO: 500,
+}
+
+// Respond with the FsError as JSON so clients can branch on `error.code`
+export const fsErrorResponse = (c: Context, e: unknown) => {
+  const error = FsError.from(e)
+  if (!error) return c.text('Error: ' + (e instanceof Error ? e.message : String(e)), 500)
+  return c.json({ error: error.toJSON() }, errorStatus[error.code] ?? 400)
+}
+
 export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
   const fsRoutes = new Hono<{ Bindings: TEnv } & DofsContext>()
 
@@ -13,27 +35,34 @@ export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
     }
     const dir = c.req.query('path') || '/'
     const finalPath = (dir.endsWith('/') ? dir : dir + '/') + file.name
-    await fs.writeFile(finalPath, file.stream())
+    try {
+      // Browsers send octet-stream for types they don't know, which detection can do better than
+      const contentType = file.type && file.type !== 'application/octet-stream' ? file.type : undefined
+      await fs.writeFile(finalPath, file.stream(), { contentType })
+    } catch (e) {
+      return fsErrorResponse(c, e)
+    }
     return c.redirect('/')
   })
 
+  // Lists a directory with stats. Pass limit (and the returned X-Dofs-Cursor) to page through large directories
   fsRoutes.get('/ls', async (c) => {
     const fs = c.get('fs')
     const path = c.req.query('path') || '/'
-    const entries = await fs.listDir(path)
-    const stats = await Promise.all(
-      entries
-        .filter((e: string) => e !== '.' && e !== '..')
-        .map(async (e: string) => {
-          try {
-            const s = await fs.stat((path.endsWith('/') ? path : path + '/') + e)
-            return { name: e, ...s }
-          } catch (err) {
-            return { name: e, error: true }
-          }
-        })
-    )
-    return c.json(stats)
+    const limit = c.req.query('limit')
+    let cursor = c.req.query('cursor')
+    const entries = []
+    try {
+      do {
+        const page = await fs.readdir(path, { withStats: true, limit: limit ? Number(limit) : undefined, cursor })
+        entries.push(...page.entries.map(({ name, stat }) => ({ name, ...stat })))
+        cursor = page.cursor
+      } while (cursor && !limit)
+    } catch (e) {
+      return fsErrorResponse(c, e)
+    }
+    if (cursor) c.header('X-Dofs-Cursor', cursor)
+    return c.json(entries)
   })
 
   fsRoutes.get('/file', async (c) => {
@@ -41,20 +70,13 @@ export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
     const path = c.req.query('path')
     if (!path) return c.text('Missing path', 400)
     try {
-      // Try to guess content type from extension
-      const ext = (path.split('.').pop() || '').toLowerCase()
-      const typeMap = {
-        jpg: 'image/jpeg',
-        jpeg: 'image/jpeg',
-        png: 'image/png',
-        gif: 'image/gif',
-        webp: 'image/webp',
-        bmp: 'image/bmp',
-        svg: 'image/svg+xml',
-      }
-      const contentType = typeMap[ext as keyof typeof typeMap] || 'application/octet-stream'
       const stat = await fs.stat(path)
       const size = stat.size
+      // Files written before content types were tracked get one from their extension
+      const contentType = stat.contentType ?? typeForPath(path) ?? 'application/octet-stream'
+      // With checksums enabled the digest changes exactly when the content does, so it makes a strong ETag
+      const etag = stat.digest ? `"${stat.digest}"` : undefined
+      if (etag && c.req.header('if-none-match') === etag) return c.body(null, 304, { etag })
       const stream = await fs.readFile(path)
       return new Response(stream, {
         status: 200,
@@ -62,10 +84,11 @@ export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
           'content-type': contentType,
           'content-disposition': `inline; filename="${encodeURIComponent(path.split('/').pop() || 'file')}"`,
           'content-length': String(size),
+          ...(etag ? { etag } : {}),
         },
       })
     } catch (e) {
-      return c.text('Not found', 404)
+      return fsErrorResponse(c, e)
     }
   })
 
@@ -77,7 +100,7 @@ export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
       await fs.unlink(path)
       return c.text('OK')
     } catch (e) {
-      return c.text('Not found', 404)
+      return fsErrorResponse(c, e)
     }
   })
 
@@ -89,7 +112,7 @@ export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
       await fs.mkdir(path)
       return c.text('OK')
     } catch (e) {
-      return c.text('Error: ' + (e instanceof Error ? e.message : String(e)), 400)
+      return fsErrorResponse(c, e)
     }
   })
 
@@ -101,7 +124,7 @@ export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
       await fs.rmdir(path)
       return c.text('OK')
     } catch (e) {
-      return c.text('Error: ' + (e instanceof Error ? e.message : String(e)), 400)
+      return fsErrorResponse(c, e)
     }
   })
 
@@ -111,10 +134,30 @@ export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
     const dest = c.req.query('dest')
     if (!src || !dest) return c.text('Missing src or dest', 400)
     try {
-      await fs.rename(src, dest)
+      await fs.rename(src, dest, {
+        noReplace: c.req.query('noReplace') === 'true',
+        exchange: c.req.query('exchange') === 'true',
+      })
+      return c.text('OK')
+    } catch (e) {
+      return fsErrorResponse(c, e)
+    }
+  })
+
+  fsRoutes.post('/cp', async (c) => {
+    const fs = c.get('fs')
+    const src = c.req.query('src')
+    const dest = c.req.query('dest')
+    if (!src || !dest) return c.text('Missing src or dest', 400)
+    try {
+      await fs.cp(src, dest, {
+        recursive: c.req.query('recursive') === 'true',
+        preserve: c.req.query('preserve') === 'true',
+        overwrite: c.req.query('overwrite') !== 'false',
+      })
       return c.text('OK')
     } catch (e) {
-      return c.text('Error: ' + (e instanceof Error ? e.message : String(e)), 400)
+      return fsErrorResponse(c, e)
     }
   })
 
@@ -127,7 +170,7 @@ export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
       await fs.symlink(target, path)
       return c.text('OK')
     } catch (e) {
-      return c.text('Error: ' + (e instanceof Error ? e.message : String(e)), 400)
+      return fsErrorResponse(c, e)
     }
   })
 
@@ -139,14 +182,75 @@ export const createFsRoutes = <TEnv extends Cloudflare.Env>() => {
       const stat = await fs.stat(path)
       return c.json(stat)
     } catch (e) {
-      return c.text('Error: ' + (e instanceof Error ? e.message : String(e)), 400)
+      return fsErrorResponse(c, e)
+    }
+  })
+
+  fsRoutes.get('/search', async (c) => {
+    const fs = c.get('fs')
+    const q = c.req.query('q')
+    if (!q) return c.text('Missing q', 400)
+    const limit = c.req.query('limit')
+    try {
+      const results = await fs.search(q, { path: c.req.query('path'), limit: limit ? Number(limit) : undefined })
+      return c.json(results)
+    } catch (e) {
+      return fsErrorResponse(c, e)
     }
   })
 
   fsRoutes.get('/df', async (c) => {
     const fs = c.get('fs')
-    const stats = await fs.getDeviceStats()
-    return c.json(stats)
+    try {
+      const stats = await fs.getDeviceStats()
+      return c.json(stats)
+    } catch (e) {
+      return fsErrorResponse(c, e)
+    }
+  })
+
+  fsRoutes.get('/du', async (c) => {
+    const fs = c.get('fs')
+    const path = c.req.query('path') || '/'
+    const maxDepth = c.req.query('maxDepth')
+    try {
+      const entries = await fs.du(path, { maxDepth: maxDepth ? Number(maxDepth) : undefined })
+      return c.json(entries)
+    } catch (e) {
+      return fsErrorResponse(c, e)
+    }
+  })
+
+  // Prometheus text format; ?format=json returns getMetrics() as is
+  fsRoutes.get('/metrics', async (c) => {
+    const fs = c.get('fs')
+    try {
+      const metrics = await fs.getMetrics()
+      if (c.req.query('format') === 'json') return c.json(metrics)
+      return c.text(toPrometheus(metrics), 200, { 'content-type': 'text/plain; version=0.0.4; charset=utf-8' })
+    } catch (e) {
+      return fsErrorResponse(c, e)
+    }
+  })
+
+  // Audit entries as JSON, filtered by since (ms), path and actor. Page with limit and the returned X-Dofs-Cursor
+  fsRoutes.get('/audit', async (c) => {
+    const fs = c.get('fs')
+    const since = c.req.query('since')
+    const limit = c.req.query('limit')
+    try {
+      const page = await fs.getAuditLog({
+        since: since ? Number(since) : undefined,
+        path: c.req.query('path'),
+        actor: c.req.query('actor'),
+        limit: limit ? Number(limit) : undefined,
+        cursor: c.req.query('cursor'),
+      })
+      if (page.cursor) c.header('X-Dofs-Cursor', page.cursor)
+      return c.json(page.entries)
+    } catch (e) {
+      return fsErrorResponse(c, e)
+    }
   })
 
   return fsRoutes
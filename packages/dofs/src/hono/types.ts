@@ -1,5 +1,6 @@
 import { DurableObject } from 'cloudflare:workers'
-import { Fs } from '../Fs.js'
+import { Context } from 'hono'
+import { Credentials, Fs } from '../Fs.js'
 
 // Extend the context type to include our fs property
 export type DofsContext = {
@@ -50,5 +51,9 @@ export interface DurableObjectConfigItem<TEnv extends Cloudflare.Env> {
  */
 export type DurableObjectConfig<TEnv extends Cloudflare.Env> = {
   resolveRootStat?: (cfg: DurableObjectConfig<TEnv>) => Promise<FsStat>
+  /** Function to get the caller's credentials; requests run as root if omitted */
+  resolveCredentials?: (c: Context<{ Bindings: TEnv } & DofsContext>) => Credentials | Promise<Credentials>
+  /** Function to get who is making the request, recorded as the actor in the audit log */
+  resolveActor?: (c: Context<{ Bindings: TEnv } & DofsContext>) => string | Promise<string>
   dos: Record<string, DurableObjectConfigItem<TEnv>>
 }
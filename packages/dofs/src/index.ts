@@ -1,2 +1,8 @@
+export * from './alarm'
 export * from './Fs'
+export * from './FsError'
+export * from './metrics'
+export * from './nodeFs'
+export * from './OverlayFs'
+export * from './path'
 export * from './withDofs'
@@ -0,0 +1,122 @@
+// Upper bounds, in milliseconds, of the latency histogram buckets
+export const LATENCY_BUCKETS = [1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000]
+
+export type LatencyHistogram = {
+  /** Calls that took at most LATENCY_BUCKETS[i] milliseconds, cumulative like Prometheus buckets */
+  buckets: number[]
+  count: number
+  /** Total milliseconds across all calls */
+  sum: number
+}
+export type MethodMetrics = {
+  calls: number
+  /** Failed calls by error code */
+  errors: Record<string, number>
+  /** SQL statements issued while the method ran */
+  queries: number
+  latency: LatencyHistogram
+}
+export type FsMetrics = {
+  volume?: string
+  /** When counting started: the Durable Object's start, since metrics are kept in memory */
+  since: number
+  bytesRead: number
+  bytesWritten: number
+  /** Every SQL statement, including background work like alarms that no method is charged for */
+  queries: number
+  methods: Record<string, MethodMetrics>
+}
+
+// Counters for one filesystem, shared by every view of it. Nothing is written to storage, so keeping them costs
+// no extra rows.
+export class MetricsRecorder {
+  readonly since = Date.now()
+  bytesRead = 0
+  bytesWritten = 0
+  queries = 0
+  private methods = new Map<string, MethodMetrics>()
+
+  call(method: string, ms: number, code?: string) {
+    const metrics = this.method(method)
+    metrics.calls++
+    if (code !== undefined) metrics.errors[code] = (metrics.errors[code] ?? 0) + 1
+    const { latency } = metrics
+    LATENCY_BUCKETS.forEach((bound, i) => {
+      if (ms <= bound) latency.buckets[i]++
+    })
+    latency.count++
+    latency.sum += ms
+  }
+
+  query(method?: string) {
+    this.queries++
+    if (method !== undefined) this.method(method).queries++
+  }
+
+  snapshot(volume?: string): FsMetrics {
+    return {
+      volume,
+      since: this.since,
+      bytesRead: this.bytesRead,
+      bytesWritten: this.bytesWritten,
+      queries: this.queries,
+      methods: structuredClone(Object.fromEntries(this.methods)),
+    }
+  }
+
+  private method(name: string) {
+    let metrics = this.methods.get(name)
+    if (!metrics) {
+      metrics = {
+        calls: 0,
+        errors: {},
+        queries: 0,
+        latency: { buckets: LATENCY_BUCKETS.map(() => 0), count: 0, sum: 0 },
+      }
+      this.methods.set(name, metrics)
+    }
+    return metrics
+  }
+}
+
+// Render metrics in the Prometheus text exposition format, with latencies in seconds as Prometheus expects
+export const toPrometheus = (metrics: FsMetrics) => {
+  const lines: string[] = []
+  const volume = metrics.volume === undefined ? [] : [`volume="${metrics.volume}"`]
+  const series = (name: string, labels: string[], value: number) => {
+    const all = [...volume, ...labels]
+    lines.push(`${name}${all.length > 0 ? `{${all.join(',')}}` : ''} ${value}`)
+  }
+  const header = (name: string, type: string, help: string) => {
+    lines.push(`# HELP ${name} ${help}`, `# TYPE ${name} ${type}`)
+  }
+  const methods = Object.entries(metrics.methods)
+
+  header('dofs_operations_total', 'counter', 'Fs method calls.')
+  for (const [method, m] of methods) series('dofs_operations_total', [`method="${method}"`], m.calls)
+  header('dofs_errors_total', 'counter', 'Failed Fs method calls by error code.')
+  for (const [method, m] of methods) {
+    for (const [code, count] of Object.entries(m.errors)) {
+      series('dofs_errors_total', [`method="${method}"`, `code="${code}"`], count)
+    }
+  }
+  header('dofs_sql_queries_total', 'counter', 'SQL statements issued while each Fs method ran.')
+  for (const [method, m] of methods) series('dofs_sql_queries_total', [`method="${method}"`], m.queries)
+  header('dofs_sql_queries_all_total', 'counter', 'All SQL statements, including background work.')
+  series('dofs_sql_queries_all_total', [], metrics.queries)
+  header('dofs_read_bytes_total', 'counter', 'File bytes returned by readFile and read.')
+  series('dofs_read_bytes_total', [], metrics.bytesRead)
+  header('dofs_written_bytes_total', 'counter', 'File bytes written.')
+  series('dofs_written_bytes_total', [], metrics.bytesWritten)
+  header('dofs_operation_duration_seconds', 'histogram', 'Fs method latency.')
+  for (const [method, m] of methods) {
+    const label = `method="${method}"`
+    LATENCY_BUCKETS.forEach((bound, i) => {
+      series('dofs_operation_duration_seconds_bucket', [label, `le="${bound / 1000}"`], m.latency.buckets[i])
+    })
+    series('dofs_operation_duration_seconds_bucket', [label, 'le="+Inf"'], m.latency.count)
+    series('dofs_operation_duration_seconds_sum', [label], m.latency.sum / 1000)
+    series('dofs_operation_duration_seconds_count', [label], m.latency.count)
+  }
+  return lines.join('\n') + '\n'
+}
@@ -0,0 +1,316 @@
+// Content type detection for files: magic bytes in the first chunk, then the extension, then a look at the text
+
+const extensionTypes: Record<string, string> = {
+  // Text and code
+  txt: 'text/plain',
+  text: 'text/plain',
+  log: 'text/plain',
+  conf: 'text/plain',
+  ini: 'text/plain',
+  cfg: 'text/plain',
+  env: 'text/plain',
+  html: 'text/html',
+  htm: 'text/html',
+  shtml: 'text/html',
+  xhtml: 'application/xhtml+xml',
+  css: 'text/css',
+  csv: 'text/csv',
+  tsv: 'text/tab-separated-values',
+  md: 'text/markdown',
+  markdown: 'text/markdown',
+  mdx: 'text/mdx',
+  rtf: 'application/rtf',
+  ics: 'text/calendar',
+  vcf: 'text/vcard',
+  vtt: 'text/vtt',
+  srt: 'application/x-subrip',
+  js: 'text/javascript',
+  mjs: 'text/javascript',
+  cjs: 'text/javascript',
+  jsx: 'text/javascript',
+  ts: 'text/typescript',
+  mts: 'text/typescript',
+  cts: 'text/typescript',
+  tsx: 'text/tsx',
+  json: 'application/json',
+  jsonc: 'application/json',
+  json5: 'application/json5',
+  jsonld: 'application/ld+json',
+  map: 'application/json',
+  webmanifest: 'application/manifest+json',
+  geojson: 'application/geo+json',
+  ndjson: 'application/x-ndjson',
+  jsonl: 'application/jsonl',
+  xml: 'application/xml',
+  xsl: 'application/xml',
+  xsd: 'application/xml',
+  rss: 'application/rss+xml',
+  atom: 'application/atom+xml',
+  yaml: 'application/yaml',
+  yml: 'application/yaml',
+  toml: 'application/toml',
+  graphql: 'application/graphql',
+  gql: 'application/graphql',
+  sql: 'application/sql',
+  sh: 'application/x-sh',
+  bash: 'application/x-sh',
+  zsh: 'application/x-sh',
+  ps1: 'text/plain',
+  bat: 'text/plain',
+  py: 'text/x-python',
+  rb: 'text/x-ruby',
+  go: 'text/x-go',
+  rs: 'text/x-rust',
+  java: 'text/x-java',
+  kt: 'text/x-kotlin',
+  swift: 'text/x-swift',
+  c: 'text/x-c',
+  h: 'text/x-c',
+  cc: 'text/x-c++',
+  cpp: 'text/x-c++',
+  hpp: 'text/x-c++',
+  cs: 'text/x-csharp',
+  php: 'application/x-httpd-php',
+  pl: 'text/x-perl',
+  lua: 'text/x-lua',
+  r: 'text/x-r',
+  scala: 'text/x-scala',
+  dart: 'text/x-dart',
+  ex: 'text/x-elixir',
+  exs: 'text/x-elixir',
+  erl: 'text/x-erlang',
+  hs: 'text/x-haskell',
+  clj: 'text/x-clojure',
+  vue: 'text/x-vue',
+  svelte: 'text/x-svelte',
+  diff: 'text/x-diff',
+  patch: 'text/x-diff',
+  tex: 'application/x-tex',
+  // Images
+  png: 'image/png',
+  apng: 'image/apng',
+  jpg: 'image/jpeg',
+  jpeg: 'image/jpeg',
+  jpe: 'image/jpeg',
+  jfif: 'image/jpeg',
+  gif: 'image/gif',
+  webp: 'image/webp',
+  avif: 'image/avif',
+  heic: 'image/heic',
+  heif: 'image/heif',
+  jxl: 'image/jxl',
+  bmp: 'image/bmp',
+  ico: 'image/vnd.microsoft.icon',
+  cur: 'image/x-icon',
+  svg: 'image/svg+xml',
+  svgz: 'image/svg+xml',
+  tif: 'image/tiff',
+  tiff: 'image/tiff',
+  psd: 'image/vnd.adobe.photoshop',
+  // Audio
+  mp3: 'audio/mpeg',
+  m4a: 'audio/mp4',
+  aac: 'audio/aac',
+  wav: 'audio/wav',
+  ogg: 'audio/ogg',
+  oga: 'audio/ogg',
+  opus: 'audio/opus',
+  flac: 'audio/flac',
+  mid: 'audio/midi',
+  midi: 'audio/midi',
+  weba: 'audio/webm',
+  aif: 'audio/aiff',
+  aiff: 'audio/aiff',
+  // Video
+  mp4: 'video/mp4',
+  m4v: 'video/mp4',
+  mov: 'video/quicktime',
+  webm: 'video/webm',
+  mkv: 'video/x-matroska',
+  ogv: 'video/ogg',
+  avi: 'video/x-msvideo',
+  wmv: 'video/x-ms-wmv',
+  flv: 'video/x-flv',
+  mpeg: 'video/mpeg',
+  mpg: 'video/mpeg',
+  m3u8: 'application/vnd.apple.mpegurl',
+  mpd: 'application/dash+xml',
+  '3gp': 'video/3gpp',
+  '3g2': 'video/3gpp2',
+  // Fonts
+  woff: 'font/woff',
+  woff2: 'font/woff2',
+  ttf: 'font/ttf',
+  otf: 'font/otf',
+  eot: 'application/vnd.ms-fontobject',
+  // Documents
+  pdf: 'application/pdf',
+  doc: 'application/msword',
+  docx: 'application/vnd.openxmlformats-officedocument.wordprocessingml.document',
+  xls: 'application/vnd.ms-excel',
+  xlsx: 'application/vnd.openxmlformats-officedocument.spreadsheetml.sheet',
+  ppt: 'application/vnd.ms-powerpoint',
+  pptx: 'application/vnd.openxmlformats-officedocument.presentationml.presentation',
+  odt: 'application/vnd.oasis.opendocument.text',
+  ods: 'application/vnd.oasis.opendocument.spreadsheet',
+  odp: 'application/vnd.oasis.opendocument.presentation',
+  epub: 'application/epub+zip',
+  // Archives and binaries
+  zip: 'application/zip',
+  gz: 'application/gzip',
+  tgz: 'application/gzip',
+  bz2: 'application/x-bzip2',
+  xz: 'application/x-xz',
+  zst: 'application/zstd',
+  br: 'application/x-brotli',
+  tar: 'application/x-tar',
+  '7z': 'application/x-7z-compressed',
+  rar: 'application/vnd.rar',
+  jar: 'application/java-archive',
+  apk: 'application/vnd.android.package-archive',
+  wasm: 'application/wasm',
+  exe: 'application/vnd.microsoft.portable-executable',
+  dll: 'application/vnd.microsoft.portable-executable',
+  deb: 'application/vnd.debian.binary-package',
+  rpm: 'application/x-rpm',
+  dmg: 'application/x-apple-diskimage',
+  iso: 'application/x-iso9660-image',
+  sqlite: 'application/vnd.sqlite3',
+  db: 'application/vnd.sqlite3',
+  parquet: 'application/vnd.apache.parquet',
+  bin: 'application/octet-stream',
+  // 3D and other data
+  glb: 'model/gltf-binary',
+  gltf: 'model/gltf+json',
+  obj: 'model/obj',
+  stl: 'model/stl',
+  usdz: 'model/vnd.usdz+zip',
+  ipynb: 'application/x-ipynb+json',
+}
+
+const ascii = (text: string) => Array.from(text, (char) => char.charCodeAt(0))
+
+// Byte signatures, where null matches any byte
+const signatures: [offset: number, bytes: (number | null)[], type: string][] = [
+  [0, [0x89, ...ascii('PNG\r\n'), 0x1a, 0x0a], 'image/png'],
+  [0, [0xff, 0xd8, 0xff], 'image/jpeg'],
+  [0, ascii('GIF87a'), 'image/gif'],
+  [0, ascii('GIF89a'), 'image/gif'],
+  [0, [...ascii('RIFF'), null, null, null, null, ...ascii('WEBP')], 'image/webp'],
+  [0, [...ascii('RIFF'), null, null, null, null, ...ascii('WAVE')], 'audio/wav'],
+  [0, [...ascii('RIFF'), null, null, null, null, ...ascii('AVI ')], 'video/x-msvideo'],
+  [0, ascii('BM'), 'image/bmp'],
+  [0, [0x00, 0x00, 0x01, 0x00], 'image/vnd.microsoft.icon'],
+  [0, [0x49, 0x49, 0x2a, 0x00], 'image/tiff'],
+  [0, [0x4d, 0x4d, 0x00, 0x2a], 'image/tiff'],
+  [0, [0xff, 0x0a], 'image/jxl'],
+  [0, ascii('8BPS'), 'image/vnd.adobe.photoshop'],
+  [0, ascii('ID3'), 'audio/mpeg'],
+  [0, [0xff, 0xfb], 'audio/mpeg'],
+  [0, [0xff, 0xf3], 'audio/mpeg'],
+  [0, [0xff, 0xf2], 'audio/mpeg'],
+  [0, [0xff, 0xf1], 'audio/aac'],
+  [0, [0xff, 0xf9], 'audio/aac'],
+  [0, ascii('fLaC'), 'audio/flac'],
+  [0, ascii('OggS'), 'audio/ogg'],
+  [0, ascii('MThd'), 'audio/midi'],
+  [0, [...ascii('FORM'), null, null, null, null, ...ascii('AIFF')], 'audio/aiff'],
+  [0, [0x1a, 0x45, 0xdf, 0xa3], 'video/webm'],
+  [0, ascii('FLV'), 'video/x-flv'],
+  [0, [0x00, 0x00, 0x01, 0xba], 'video/mpeg'],
+  [0, [0x00, 0x00, 0x01, 0xb3], 'video/mpeg'],
+  [0, ascii('%PDF-'), 'application/pdf'],
+  [0, [0x50, 0x4b, 0x03, 0x04], 'application/zip'],
+  [0, [0x50, 0x4b, 0x05, 0x06], 'application/zip'],
+  [0, [0x1f, 0x8b], 'application/gzip'],
+  [0, ascii('BZh'), 'application/x-bzip2'],
+  [0, [0xfd, ...ascii('7zXZ'), 0x00], 'application/x-xz'],
+  [0, [0x28, 0xb5, 0x2f, 0xfd], 'application/zstd'],
+  [0, [...ascii('7z'), 0xbc, 0xaf, 0x27, 0x1c], 'application/x-7z-compressed'],
+  [0, [...ascii('Rar!'), 0x1a, 0x07], 'application/vnd.rar'],
+  [257, ascii('ustar'), 'application/x-tar'],
+  [0, [0x00, ...ascii('asm')], 'application/wasm'],
+  [0, [0x7f, ...ascii('ELF')], 'application/x-elf'],
+  [0, ascii('MZ'), 'application/vnd.microsoft.portable-executable'],
+  [0, ascii('SQLite format 3'), 'application/vnd.sqlite3'],
+  [0, ascii('PAR1'), 'application/vnd.apache.parquet'],
+  [0, ascii('wOFF'), 'font/woff'],
+  [0, ascii('wOF2'), 'font/woff2'],
+  [0, [0x00, 0x01, 0x00, 0x00, 0x00], 'font/ttf'],
+  [0, ascii('OTTO'), 'font/otf'],
+  [0, ascii('glTF'), 'model/gltf-binary'],
+  [0, [0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1], 'application/x-cfb'],
+]
+
+// ISO base media (MP4 family) files start with a box whose type is 'ftyp', followed by the major brand
+const ftypBrands: Record<string, string> = {
+  avif: 'image/avif',
+  avis: 'image/avif',
+  heic: 'image/heic',
+  heix: 'image/heic',
+  mif1: 'image/heif',
+  msf1: 'image/heif',
+  'M4A ': 'audio/mp4',
+  'M4B ': 'audio/mp4',
+  'M4V ': 'video/mp4',
+  'qt  ': 'video/quicktime',
+  '3gp4': 'video/3gpp',
+  '3gp5': 'video/3gpp',
+  '3g2a': 'video/3gpp2',
+}
+
+const matches = (head: Uint8Array, offset: number, bytes: (number | null)[]) =>
+  head.length >= offset + bytes.length && bytes.every((byte, i) => byte === null || head[offset + i] === byte)
+
+const sniffBinary = (head: Uint8Array): string | undefined => {
+  if (matches(head, 4, ascii('ftyp'))) {
+    const brand = String.fromCharCode(...head.subarray(8, 12))
+    return ftypBrands[brand] ?? 'video/mp4'
+  }
+  return signatures.find(([offset, bytes]) => matches(head, offset, bytes))?.[2]
+}
+
+// Markup that browsers render, recognised by how it starts after any BOM and whitespace
+const sniffMarkup = (head: Uint8Array): string | undefined => {
+  const start = new TextDecoder().decode(head.subarray(0, 512)).replace(/^\uFEFF/, '').trimStart().toLowerCase()
+  if (/^<(!doctype html|html|head|body|script|iframe|title|div|p|h1)[\s>]/.test(start)) return 'text/html'
+  if (start.startsWith('<svg')) return 'image/svg+xml'
+  if (start.startsWith('<?xml')) return start.includes('<svg') ? 'image/svg+xml' : 'application/xml'
+  if (start.startsWith('%!ps')) return 'application/postscript'
+  return undefined
+}
+
+// No NUL bytes and valid UTF-8, allowing a multi-byte character cut off at the end of the chunk
+const looksLikeText = (head: Uint8Array) => {
+  if (head.includes(0)) return false
+  try {
+    new TextDecoder('utf-8', { fatal: true }).decode(head, { stream: true })
+    return true
+  } catch {
+    return false
+  }
+}
+
+// Content type for a file name by its extension
+export const typeForPath = (path: string): string | undefined => {
+  const name = path.split('/').pop() ?? ''
+  const dot = name.lastIndexOf('.')
+  if (dot <= 0) return undefined
+  return extensionTypes[name.slice(dot + 1).toLowerCase()]
+}
+
+// Detect a file's content type from its path and, when available, the start of its data
+export const detectContentType = (path: string, head?: Uint8Array): string => {
+  const byExtension = typeForPath(path)
+  const text = !!head && head.length > 0 && looksLikeText(head)
+  // Signatures are only trusted on binary data, so a text file that happens to start with "BM" or "OTTO" isn't an image
+  const sniffed = head && !text ? sniffBinary(head) : undefined
+  if (sniffed) {
+    // Formats built on zip or MP4 containers (.docx, .epub, .m4a) sniff as the container; the extension says more
+    const container = sniffed === 'application/zip' || sniffed === 'video/mp4'
+    return container && byExtension ? byExtension : sniffed
+  }
+  if (byExtension) return byExtension
+  if (text) return sniffMarkup(head!) ?? 'text/plain'
+  return 'application/octet-stream'
+}
@@ -0,0 +1,547 @@
+import { F_OK, Fs, R_OK, Stat, W_OK, X_OK } from './Fs.js'
+import { FsError } from './FsError.js'
+
+// File type bits for Stats.mode, keyed by the dofs inode kind
+const S_IFMT = 0o170000
+const fileTypeBits: Record<string, number> = {
+  File: 0o100000,
+  Directory: 0o040000,
+  Symlink: 0o120000,
+  NamedPipe: 0o010000,
+  CharDevice: 0o020000,
+  BlockDevice: 0o060000,
+  Socket: 0o140000,
+}
+
+export const nodeConstants = {
+  F_OK,
+  R_OK,
+  W_OK,
+  X_OK,
+  S_IFMT,
+  S_IFREG: fileTypeBits.File,
+  S_IFDIR: fileTypeBits.Directory,
+  S_IFLNK: fileTypeBits.Symlink,
+  S_IFIFO: fileTypeBits.NamedPipe,
+  S_IFCHR: fileTypeBits.CharDevice,
+  S_IFBLK: fileTypeBits.BlockDevice,
+  S_IFSOCK: fileTypeBits.Socket,
+  COPYFILE_EXCL: 1,
+}
+
+export type NodeEncoding = string | null | undefined
+export type NodeReadFileOptions = NodeEncoding | { encoding?: NodeEncoding; flag?: string }
+export type NodeWriteFileOptions = NodeEncoding | { encoding?: NodeEncoding; mode?: number; flag?: string }
+export type NodeData = string | Uint8Array | ArrayBuffer
+export type NodeTime = number | string | Date
+
+// Mirror of Node's fs.Stats, built from a dofs Stat
+export class NodeStats {
+  dev = 0
+  ino: number
+  mode: number
+  nlink: number
+  uid: number
+  gid: number
+  rdev: number
+  size: number
+  blksize: number
+  blocks: number
+  atimeMs: number
+  mtimeMs: number
+  ctimeMs: number
+  birthtimeMs: number
+  atime: Date
+  mtime: Date
+  ctime: Date
+  birthtime: Date
+
+  constructor(stat: Stat) {
+    const kind = stat.kind ?? (stat.isDirectory ? 'Directory' : 'File')
+    this.ino = stat.ino ?? 0
+    this.mode = (fileTypeBits[kind] ?? 0) | ((stat.mode ?? 0) & ~S_IFMT)
+    this.nlink = stat.nlink ?? 1
+    this.uid = stat.uid ?? 0
+    this.gid = stat.gid ?? 0
+    this.rdev = stat.rdev ?? 0
+    this.size = stat.size
+    this.blksize = stat.blksize ?? 512
+    this.blocks = stat.blocks ?? 0
+    this.atimeMs = stat.atime ?? 0
+    this.mtimeMs = stat.mtime ?? 0
+    this.ctimeMs = stat.ctime ?? 0
+    this.birthtimeMs = stat.crtime ?? 0
+    this.atime = new Date(this.atimeMs)
+    this.mtime = new Date(this.mtimeMs)
+    this.ctime = new Date(this.ctimeMs)
+    this.birthtime = new Date(this.birthtimeMs)
+  }
+
+  isFile() {
+    return (this.mode & S_IFMT) === nodeConstants.S_IFREG
+  }
+  isDirectory() {
+    return (this.mode & S_IFMT) === nodeConstants.S_IFDIR
+  }
+  isSymbolicLink() {
+    return (this.mode & S_IFMT) === nodeConstants.S_IFLNK
+  }
+  isFIFO() {
+    return (this.mode & S_IFMT) === nodeConstants.S_IFIFO
+  }
+  isCharacterDevice() {
+    return (this.mode & S_IFMT) === nodeConstants.S_IFCHR
+  }
+  isBlockDevice() {
+    return (this.mode & S_IFMT) === nodeConstants.S_IFBLK
+  }
+  isSocket() {
+    return (this.mode & S_IFMT) === nodeConstants.S_IFSOCK
+  }
+}
+
+// Mirror of Node's fs.Dirent
+export class NodeDirent {
+  name: string
+  parentPath: string
+  path: string
+  private type: number
+
+  constructor(name: string, parentPath: string, kind: string) {
+    this.name = name
+    this.parentPath = parentPath
+    this.path = parentPath
+    this.type = fileTypeBits[kind] ?? 0
+  }
+
+  isFile() {
+    return this.type === nodeConstants.S_IFREG
+  }
+  isDirectory() {
+    return this.type === nodeConstants.S_IFDIR
+  }
+  isSymbolicLink() {
+    return this.type === nodeConstants.S_IFLNK
+  }
+  isFIFO() {
+    return this.type === nodeConstants.S_IFIFO
+  }
+  isCharacterDevice() {
+    return this.type === nodeConstants.S_IFCHR
+  }
+  isBlockDevice() {
+    return this.type === nodeConstants.S_IFBLK
+  }
+  isSocket() {
+    return this.type === nodeConstants.S_IFSOCK
+  }
+}
+
+export type NodeFs = ReturnType<typeof createNodeFs>
+export type FileHandle = Awaited<ReturnType<NodeFs['open']>>
+
+// Convert an FsError (possibly flattened by RPC) into the shape Node's fs errors have
+const toNodeError = (e: unknown) => {
+  const error = FsError.from(e)
+  if (!error) return e
+  return Object.assign(new Error(error.message), {
+    code: error.code,
+    errno: -error.errno,
+    syscall: error.syscall,
+    path: error.path,
+    dest: error.dest,
+  })
+}
+
+const call = async <T>(fn: () => T | Promise<T>): Promise<Awaited<T>> => {
+  try {
+    return await fn()
+  } catch (e) {
+    throw toNodeError(e)
+  }
+}
+
+const encodingOf = (options?: NodeReadFileOptions | NodeWriteFileOptions) =>
+  (typeof options === 'object' && options !== null ? options.encoding : options) ?? undefined
+
+const flagOf = (options: NodeReadFileOptions | NodeWriteFileOptions | undefined, fallback: string) =>
+  (typeof options === 'object' && options !== null ? options.flag : undefined) ?? fallback
+
+// The string encodings Node's fs accepts, by the name they're handled under. Buffer isn't available without
+// nodejs_compat, so they're converted here.
+const ENCODINGS: Record<string, string> = {
+  utf8: 'utf8',
+  'utf-8': 'utf8',
+  ascii: 'ascii',
+  latin1: 'latin1',
+  binary: 'latin1',
+  utf16le: 'utf16le',
+  'utf-16le': 'utf16le',
+  ucs2: 'utf16le',
+  'ucs-2': 'utf16le',
+  base64: 'base64',
+  base64url: 'base64url',
+  hex: 'hex',
+}
+
+const encodingName = (encoding: string) => {
+  const name = ENCODINGS[encoding.toLowerCase()]
+  if (!name) throw new FsError('EINVAL')
+  return name
+}
+
+// One char per byte, in slices so large files don't overflow the call stack
+const bytesToLatin1 = (bytes: Uint8Array) => {
+  let result = ''
+  for (let i = 0; i < bytes.length; i += 0x8000) result += String.fromCharCode(...bytes.subarray(i, i + 0x8000))
+  return result
+}
+
+const encode = (data: string, encoding: string): Uint8Array => {
+  switch (encodingName(encoding)) {
+    case 'ascii':
+    case 'latin1':
+      return Uint8Array.from(data, (c) => c.charCodeAt(0) & 0xff)
+    case 'utf16le': {
+      const bytes = new Uint8Array(data.length * 2)
+      for (let i = 0; i < data.length; i++) {
+        const code = data.charCodeAt(i)
+        bytes[i * 2] = code & 0xff
+        bytes[i * 2 + 1] = code >> 8
+      }
+      return bytes
+    }
+    case 'base64':
+    case 'base64url': {
+      // Like Node, either alphabet is accepted and padding and anything else are skipped
+      const base64 = data.replace(/-/g, '+').replace(/_/g, '/').replace(/[^A-Za-z0-9+/]/g, '')
+      return Uint8Array.from(atob(base64.length % 4 === 1 ? base64.slice(0, -1) : base64), (c) => c.charCodeAt(0))
+    }
+    case 'hex': {
+      // Like Node, decoding stops at the first pair that isn't hex
+      const bytes: number[] = []
+      for (let i = 0; i + 1 < data.length; i += 2) {
+        const pair = data.slice(i, i + 2)
+        if (!/^[0-9a-f]{2}$/i.test(pair)) break
+        bytes.push(parseInt(pair, 16))
+      }
+      return new Uint8Array(bytes)
+    }
+    default:
+      return new TextEncoder().encode(data)
+  }
+}
+
+const decode = (bytes: Uint8Array, encoding: string) => {
+  switch (encodingName(encoding)) {
+    case 'ascii':
+      return bytesToLatin1(bytes.map((b) => b & 0x7f))
+    case 'latin1':
+      return bytesToLatin1(bytes)
+    case 'utf16le': {
+      let result = ''
+      for (let i = 0; i + 1 < bytes.length; i += 2) result += String.fromCharCode(bytes[i] | (bytes[i + 1] << 8))
+      return result
+    }
+    case 'base64':
+      return btoa(bytesToLatin1(bytes))
+    case 'base64url':
+      return btoa(bytesToLatin1(bytes)).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+    case 'hex':
+      return Array.from(bytes, (b) => b.toString(16).padStart(2, '0')).join('')
+    default:
+      return new TextDecoder().decode(bytes)
+  }
+}
+
+const toBytes = (data: NodeData, encoding?: NodeEncoding) => {
+  if (typeof data === 'string') return encode(data, encoding ?? 'utf8')
+  return data instanceof ArrayBuffer ? new Uint8Array(data) : data
+}
+
+// Copy a view into a standalone ArrayBuffer, which is what Fs accepts
+const toArrayBuffer = (bytes: Uint8Array) =>
+  bytes.buffer.slice(bytes.byteOffset, bytes.byteOffset + bytes.byteLength) as ArrayBuffer
+
+const toMs = (time: NodeTime) => {
+  if (time instanceof Date) return time.getTime()
+  if (typeof time === 'string') return Number(time) * 1000
+  return time * 1000
+}
+
+const joinPath = (dir: string, name: string) => (dir.endsWith('/') ? dir + name : `${dir}/${name}`)
+
+const readStream = async (stream: ReadableStream<Uint8Array>) => {
+  const parts: Uint8Array[] = []
+  let length = 0
+  const reader = stream.getReader()
+  while (true) {
+    const { value, done } = await reader.read()
+    if (done) break
+    parts.push(value)
+    length += value.length
+  }
+  const result = new Uint8Array(length)
+  let offset = 0
+  for (const part of parts) {
+    result.set(part, offset)
+    offset += part.length
+  }
+  return result
+}
+
+/**
+ * Create an object implementing the node:fs/promises API on top of an Fs instance or an Fs RPC stub,
+ * so libraries written against Node's fs can run against dofs.
+ */
+export const createNodeFs = (fsOrStub: Fs | Rpc.Stub<Fs>) => {
+  // Direct calls return values and stub calls return promises; awaiting handles both
+  const fs = fsOrStub as Fs
+  let nextFd = 3
+
+  const stat = (path: string) => call(async () => new NodeStats(await fs.stat(path)))
+  const lstat = (path: string) => call(async () => new NodeStats(await fs.lstat(path)))
+
+  const exists = async (path: string) => {
+    try {
+      await fs.stat(path)
+      return true
+    } catch (e) {
+      if (FsError.from(e)?.code === 'ENOENT') return false
+      throw toNodeError(e)
+    }
+  }
+
+  const readFile = (path: string, options?: NodeReadFileOptions): Promise<any> =>
+    call(async () => {
+      const bytes = await readStream(await fs.readFile(path))
+      const encoding = encodingOf(options)
+      return encoding ? decode(bytes, encoding) : bytes
+    })
+
+  const appendFile = (path: string, data: NodeData, options?: NodeWriteFileOptions) =>
+    call(async () => {
+      const bytes = toBytes(data, encodingOf(options))
+      let offset = 0
+      if (await exists(path)) {
+        offset = (await fs.stat(path)).size
+      } else {
+        await fs.create(path, { mode: typeof options === 'object' ? options?.mode : undefined })
+      }
+      await fs.write(path, toArrayBuffer(bytes), { offset })
+    })
+
+  const writeFile = (path: string, data: NodeData, options?: NodeWriteFileOptions) =>
+    call(async () => {
+      const flag = flagOf(options, 'w')
+      if (flag.startsWith('a')) return appendFile(path, data, options)
+      const existed = await exists(path)
+      if (flag.includes('x') && existed) throw new FsError('EEXIST', 'open', path)
+      await fs.writeFile(path, toArrayBuffer(toBytes(data, encodingOf(options))))
+      const mode = typeof options === 'object' ? options?.mode : undefined
+      if (!existed && mode !== undefined) await fs.setattr(path, { mode })
+    })
+
+  const readdir = (path: string, options?: { withFileTypes?: boolean; recursive?: boolean }): Promise<any[]> =>
+    call(async () => {
+      const entries: NodeDirent[] = []
+      let cursor: string | undefined
+      if (options?.recursive) {
+        const root = path.endsWith('/') ? path : path + '/'
+        do {
+          const page = await fs.find(path, { cursor })
+          for (const { path: full, stat } of page.entries) {
+            const slash = full.lastIndexOf('/')
+            entries.push(new NodeDirent(full.slice(slash + 1), full.slice(0, slash) || '/', stat.kind ?? 'File'))
+          }
+          cursor = page.cursor
+        } while (cursor)
+        if (!options.withFileTypes) return entries.map((d) => joinPath(d.parentPath, d.name).slice(root.length))
+        return entries
+      }
+      do {
+        const page = await fs.readdir(path, { cursor })
+        entries.push(...page.entries.map(({ name, kind }) => new NodeDirent(name, path, kind)))
+        cursor = page.cursor
+      } while (cursor)
+      return options?.withFileTypes ? entries : entries.map((d) => d.name)
+    })
+
+  const mkdir = (path: string, options?: number | { recursive?: boolean; mode?: number }) =>
+    call(async () => {
+      const opts = typeof options === 'number' ? { mode: options } : options
+      await fs.mkdir(path, { recursive: opts?.recursive, mode: opts?.mode })
+      return undefined
+    })
+
+  const rm = (path: string, options?: { recursive?: boolean; force?: boolean }) =>
+    call(async () => {
+      let isDirectory: boolean
+      try {
+        // A symlink to a directory is removed, not its target
+        isDirectory = (await fs.lstat(path)).isDirectory
+      } catch (e) {
+        if (options?.force && FsError.from(e)?.code === 'ENOENT') return
+        throw e
+      }
+      if (!isDirectory) return fs.unlink(path)
+      if (!options?.recursive) throw new FsError('EISDIR', 'rm', path)
+      await fs.rmdir(path, { recursive: true })
+    })
+
+  const open = (path: string, flags: string = 'r', mode?: number) =>
+    call(async () => {
+      const readable = flags.startsWith('r') || flags.includes('+')
+      const writable = !flags.startsWith('r') || flags.includes('+')
+      const append = flags.startsWith('a')
+      const existed = await exists(path)
+      if (!existed && flags.startsWith('r')) throw new FsError('ENOENT', 'open', path)
+      if (existed && flags.includes('x')) throw new FsError('EEXIST', 'open', path)
+      if (!existed) await fs.create(path, { mode })
+      else if (flags.startsWith('w')) await fs.truncate(path, 0)
+      return createFileHandle(path, { readable, writable, append })
+    })
+
+  const createFileHandle = (path: string, access: { readable: boolean; writable: boolean; append: boolean }) => {
+    const fd = nextFd++
+    let closed = false
+    let position = 0
+    const check = (allowed: boolean, syscall: string) => {
+      if (closed || !allowed) throw new FsError('EBADF', syscall, path)
+    }
+    return {
+      fd,
+      async read(buffer: Uint8Array, offset = 0, length = buffer.byteLength - offset, at: number | null = null) {
+        return call(async () => {
+          check(access.readable, 'read')
+          const start = at ?? position
+          const size = (await fs.stat(path)).size
+          const count = Math.max(0, Math.min(length, size - start))
+          if (count > 0) {
+            const data = new Uint8Array(await fs.read(path, { offset: start, length: count }))
+            buffer.set(data, offset)
+          }
+          if (at === null) position += count
+          return { bytesRead: count, buffer }
+        })
+      },
+      async write(data: NodeData, offsetOrPosition?: number | null, lengthOrEncoding?: number | string, at?: number | null) {
+        return call(async () => {
+          check(access.writable, 'write')
+          let bytes: Uint8Array
+          let target: number | null | undefined
+          if (typeof data === 'string') {
+            bytes = toBytes(data, typeof lengthOrEncoding === 'string' ? lengthOrEncoding : undefined)
+            target = offsetOrPosition
+          } else {
+            const view = toBytes(data)
+            const offset = offsetOrPosition ?? 0
+            const length = typeof lengthOrEncoding === 'number' ? lengthOrEncoding : view.byteLength - offset
+            bytes = view.subarray(offset, offset + length)
+            target = at
+          }
+          const start = access.append ? (await fs.stat(path)).size : (target ?? position)
+          await fs.write(path, toArrayBuffer(bytes), { offset: start })
+          if (target === null || target === undefined) position = start + bytes.byteLength
+          return { bytesWritten: bytes.byteLength, buffer: data }
+        })
+      },
+      async readFile(options?: NodeReadFileOptions) {
+        return call(() => {
+          check(access.readable, 'read')
+          return readFile(path, options)
+        })
+      },
+      async writeFile(data: NodeData, options?: NodeWriteFileOptions) {
+        return call(() => {
+          check(access.writable, 'write')
+          return access.append ? appendFile(path, data, options) : writeFile(path, data, options)
+        })
+      },
+      async appendFile(data: NodeData, options?: NodeWriteFileOptions) {
+        return call(() => {
+          check(access.writable, 'write')
+          return appendFile(path, data, options)
+        })
+      },
+      async stat() {
+        return call(() => {
+          check(true, 'fstat')
+          return stat(path)
+        })
+      },
+      async truncate(len = 0) {
+        return call(() => {
+          check(access.writable, 'ftruncate')
+          return fs.truncate(path, len)
+        })
+      },
+      async chmod(mode: number) {
+        return call(() => {
+          check(true, 'fchmod')
+          return fs.setattr(path, { mode })
+        })
+      },
+      async chown(uid: number, gid: number) {
+        return call(() => {
+          check(true, 'fchown')
+          return fs.setattr(path, { uid, gid })
+        })
+      },
+      async utimes(atime: NodeTime, mtime: NodeTime) {
+        return call(() => {
+          check(true, 'futime')
+          return fs.utimes(path, toMs(atime), toMs(mtime))
+        })
+      },
+      // Writes go straight to SQLite, so there is nothing to flush
+      async sync() {
+        return call(() => check(true, 'fsync'))
+      },
+      async datasync() {
+        return call(() => check(true, 'fdatasync'))
+      },
+      async close() {
+        closed = true
+      },
+    }
+  }
+
+  return {
+    constants: nodeConstants,
+    access: (path: string, mode: number = F_OK) => call(() => fs.access(path, mode)),
+    readFile,
+    writeFile,
+    appendFile,
+    readdir,
+    stat,
+    lstat,
+    realpath: (path: string) => call(() => fs.realpath(path)),
+    mkdir,
+    rm,
+    rmdir: (path: string, options?: { recursive?: boolean }) => call(() => fs.rmdir(path, options)),
+    unlink: (path: string) => call(() => fs.unlink(path)),
+    rename: (oldPath: string, newPath: string) => call(() => fs.rename(oldPath, newPath)),
+    copyFile: (src: string, dest: string, mode = 0) =>
+      call(() => fs.copyFile(src, dest, { overwrite: !(mode & nodeConstants.COPYFILE_EXCL) })),
+    cp: (src: string, dest: string, options?: { recursive?: boolean; force?: boolean; preserveTimestamps?: boolean }) =>
+      call(() =>
+        fs.cp(src, dest, {
+          recursive: options?.recursive,
+          overwrite: options?.force ?? true,
+          preserve: options?.preserveTimestamps,
+        })
+      ),
+    symlink: (target: string, path: string) => call(() => fs.symlink(target, path)),
+    readlink: (path: string) => call(() => fs.readlink(path)),
+    truncate: (path: string, len = 0) => call(() => fs.truncate(path, len)),
+    chmod: (path: string, mode: number) => call(() => fs.setattr(path, { mode })),
+    chown: (path: string, uid: number, gid: number) => call(() => fs.setattr(path, { uid, gid })),
+    lchown: (path: string, uid: number, gid: number) =>
+      call(() => fs.setattr(path, { uid, gid, followSymlinks: false })),
+    utimes: (path: string, atime: NodeTime, mtime: NodeTime) => call(() => fs.utimes(path, toMs(atime), toMs(mtime))),
+    lutimes: (path: string, atime: NodeTime, mtime: NodeTime) =>
+      call(() => fs.utimes(path, toMs(atime), toMs(mtime), { followSymlinks: false })),
+    open,
+  }
+}
@@ -0,0 +1,75 @@
+import { FsError } from './FsError.js'
+
+export type PathOptions = {
+  /** Store and look up names in Unicode NFC, so composed and decomposed spellings (as macOS sends) are one name */
+  normalizeUnicode?: boolean
+  /** Match names regardless of case, keeping the case they were created with */
+  caseInsensitive?: boolean
+  /** Most names in one path (default 256) */
+  maxDepth?: number
+}
+
+// Linux limits: bytes in one name, and in a whole path including its terminating NUL
+export const NAME_MAX = 255
+export const PATH_MAX = 4096
+export const DEFAULT_MAX_DEPTH = 256
+
+const encoder = new TextEncoder()
+// NUL, the other C0 controls and DEL, which FUSE and most shells can't pass through safely
+const CONTROL_CHARS = /[\u0000-\u001f\u007f]/
+
+// Check one name, returning it in the form it's stored and looked up under
+export const validateName = (name: string, options: PathOptions = {}) => {
+  if (CONTROL_CHARS.test(name)) throw new FsError('EINVAL')
+  const normalized = options.normalizeUnicode ? name.normalize('NFC') : name
+  if (encoder.encode(normalized).length > NAME_MAX) throw new FsError('ENAMETOOLONG')
+  return normalized
+}
+
+// Symlink targets are stored as given, but like any path can't contain NUL or exceed PATH_MAX
+export const validateTarget = (target: string) => {
+  if (target === '') throw new FsError('ENOENT')
+  if (target.includes('\u0000')) throw new FsError('EINVAL')
+  if (encoder.encode(target).length >= PATH_MAX) throw new FsError('ENAMETOOLONG')
+}
+
+// Split a path into names, dropping empty and '.' components. '..' is kept: after a symlink it means the parent of
+// the link's target, so only a lookup can resolve it.
+export const parsePath = (path: string, options: PathOptions = {}): string[] => {
+  if (typeof path !== 'string') throw new FsError('EINVAL')
+  if (encoder.encode(path).length >= PATH_MAX) throw new FsError('ENAMETOOLONG')
+  const parts: string[] = []
+  for (const part of path.split('/')) {
+    if (part === '' || part === '.') continue
+    parts.push(part === '..' ? part : validateName(part, options))
+  }
+  if (parts.length > (options.maxDepth ?? DEFAULT_MAX_DEPTH)) throw new FsError('ENAMETOOLONG')
+  return parts
+}
+
+export const normalizePath = (path: string, options?: PathOptions) => '/' + parsePath(path, options).join('/')
+
+// Resolve '..' against the names before it without a lookup, for OverlayFs, which works on paths across two
+// filesystems. Every path is absolute, so '..' at the root stays there.
+export const collapsePath = (path: string, options?: PathOptions) => {
+  const parts: string[] = []
+  for (const part of parsePath(path, options)) {
+    if (part === '..') parts.pop()
+    else parts.push(part)
+  }
+  return '/' + parts.join('/')
+}
+
+// The parent directory's path and the final name. The name is undefined for the root and for a path ending in
+// '..', neither of which names an entry that can be created
+export const splitPath = (path: string, options?: PathOptions) => {
+  const parts = parsePath(path, options)
+  const last: string | undefined = parts[parts.length - 1]
+  const name = last === '..' ? undefined : last
+  return { parts, parent: '/' + parts.slice(0, -1).join('/'), name }
+}
+
+export const joinPath = (dir: string, name: string) => (dir.endsWith('/') ? dir + name : `${dir}/${name}`)
+
+// The form two names are compared in when lookups are case-insensitive
+export const foldName = (name: string) => name.toLowerCase()
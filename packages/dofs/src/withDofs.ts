@@ -1,39 +1,79 @@
 import { DurableObject } from 'cloudflare:workers'
+import { claimAlarm } from './alarm.js'
 import { Fs, FsOptions } from './Fs.js'
+import { FsError } from './FsError.js'
+
+export type DofsOptions = FsOptions & {
+  /** Additional filesystems in the same Durable Object, each in its own tables, reachable with getFs(name) */
+  volumes?: Record<string, Omit<FsOptions, 'volume'>>
+}
 
 export type WithDofs<TEnv extends Cloudflare.Env> = DurableObject<TEnv> & {
-  getFs: () => Fs
+  getFs: (volume?: string) => Fs
+}
+
+// The default filesystem plus one per named volume
+const createVolumes = (ctx: DurableObjectState, env: Cloudflare.Env, options: DofsOptions) => {
+  const { volumes = {}, ...defaults } = options
+  const fs = new Fs(ctx, env, defaults)
+  const named = new Map(Object.entries(volumes).map(([volume, opts]) => [volume, new Fs(ctx, env, { ...opts, volume })]))
+  const getFs = (volume?: string) => {
+    if (volume === undefined) return fs
+    const found = named.get(volume)
+    if (!found) throw new FsError('ENOENT', 'getFs', volume)
+    return found
+  }
+  // Every volume gets to run its background work; each reschedules the shared alarm if it needs to. Resolves to
+  // whether the host's own alarm was due too.
+  const alarm = async () => {
+    const hostDue = claimAlarm(ctx.storage)
+    await Promise.all([fs, ...named.values()].map((volume) => volume.alarm()))
+    return hostDue
+  }
+  return { fs, getFs, alarm }
 }
 
 // Utility to create the extended class
 export const withDofs = <TEnv extends Cloudflare.Env>(
   cls: new (ctx: DurableObjectState, env: TEnv) => DurableObject<TEnv>,
-  options: FsOptions = {}
+  options: DofsOptions = {}
 ): new (ctx: DurableObjectState, env: TEnv) => WithDofs<TEnv> => {
   return class DurableObjectWithDofs extends cls {
     fs: Fs
+    volumes: ReturnType<typeof createVolumes>
     constructor(ctx: DurableObjectState, env: TEnv) {
       super(ctx, env)
-      this.fs = new Fs(ctx, env, options)
+      this.volumes = createVolumes(ctx, env, options)
+      this.fs = this.volumes.fs
     }
-    getFs(): Fs {
-      return this.fs
+    getFs(volume?: string): Fs {
+      return this.volumes.getFs(volume)
+    }
+    // dofs uses the alarm for background work like purging the trash; the class's own alarm() only runs when its
+    // alarm was due
+    async alarm(alarmInfo?: AlarmInvocationInfo) {
+      if (await this.volumes.alarm()) await super.alarm?.(alarmInfo)
     }
   }
 }
 
-export function Dofs<TEnv extends Cloudflare.Env>(options: FsOptions = {}) {
+export function Dofs<TEnv extends Cloudflare.Env>(options: DofsOptions = {}) {
   return function <T extends new (ctx: DurableObjectState, env: TEnv) => DurableObject<TEnv>>(
     target: new (ctx: DurableObjectState, env: TEnv) => DurableObject<TEnv>
   ): new (ctx: DurableObjectState, env: TEnv) => WithDofs<TEnv> {
     return class extends target {
       fs: Fs
+      volumes: ReturnType<typeof createVolumes>
       constructor(ctx: DurableObjectState, env: TEnv) {
         super(ctx, env)
-        this.fs = new Fs(ctx, env, options)
+        this.volumes = createVolumes(ctx, env, options)
+        this.fs = this.volumes.fs
+      }
+      getFs(volume?: string): Fs {
+        return this.volumes.getFs(volume)
       }
-      getFs(): Fs {
-        return this.fs
+      async alarm(alarmInfo?: AlarmInvocationInfo) {
+        if (await this.volumes.alarm()) await super.alarm?.(alarmInfo)
       }
     }
   }
@@ -0,0 +1,20 @@
+import { describe, expect, it } from 'vitest'
+import { FsError } from '../src/FsError.js'
+
+describe('FsError.from', () => {
+  it('rebuilds errors flattened by RPC from their code or message', () => {
+    expect(FsError.from({ code: 'ENOENT', syscall: 'open', path: '/f' })).toMatchObject({ code: 'ENOENT', path: '/f' })
+    expect(FsError.from(new Error("EEXIST: file already exists, mkdir '/d'"))).toMatchObject({
+      code: 'EEXIST',
+      syscall: 'mkdir',
+      path: '/d',
+    })
+  })
+
+  it('ignores codes inherited from Object.prototype', () => {
+    for (const code of ['toString', 'constructor', '__proto__', 'hasOwnProperty']) {
+      expect(FsError.from({ code })).toBeUndefined()
+    }
+    expect(FsError.from(new Error('boom'))).toBeUndefined()
+  })
+})
@@ -0,0 +1,62 @@
+import { env } from 'cloudflare:test'
+import { describe, expect, it, vi } from 'vitest'
+import { claimAlarm } from '../src/alarm.js'
+import { Fs } from '../src/Fs.js'
+import { withFs } from './helpers.js'
+
+// The alarm is set once getAlarm() resolves, so give that a moment first
+const nextAlarm = async (state: DurableObjectState) => {
+  await new Promise((resolve) => setTimeout(resolve, 10))
+  return state.storage.getAlarm()
+}
+
+describe('alarm', () => {
+  it('deletes expired entries whatever the credentials of the Fs running it', () =>
+    withFs(undefined, async (fs, state) => {
+      fs.mkdir('/dir')
+      await fs.writeFile('/dir/a', 'x', { ttlMs: 0 })
+      await fs.writeFile('/b', 'x', { ttlMs: 60_000 })
+      const userFs = new Fs(state, env, { credentials: { uid: 1000, gid: 1000 } })
+      await userFs.alarm()
+      expect(() => fs.stat('/dir/a')).toThrow(/^ENOENT/)
+      expect(fs.stat('/b').expiresAt).toBeDefined()
+      expect(await nextAlarm(state)).toBe(fs.stat('/b').expiresAt)
+    }))
+
+  it('carries on past an entry that fails to delete and retries it later', () =>
+    withFs(undefined, async (fs, state) => {
+      await fs.writeFile('/a', 'x', { ttlMs: 0 })
+      await fs.writeFile('/b', 'x', { ttlMs: 0 })
+      const removeTree = vi.spyOn(fs as any, 'removeTree').mockImplementationOnce(() => {
+        throw new Error('boom')
+      })
+      const before = Date.now()
+      await fs.alarm()
+      removeTree.mockRestore()
+      expect(fs.listDir('/').filter((name) => name !== '.' && name !== '..')).toHaveLength(1)
+      const [left] = fs.readdir('/').entries
+      const retryAt = fs.stat(`/${left.name}`).expiresAt!
+      expect(retryAt).toBeGreaterThan(before)
+      expect(await nextAlarm(state)).toBe(retryAt)
+    }))
+
+  it('is set again when tiering fails', () =>
+    withFs(
+      {
+        tiering: {
+          bucket: { put: () => Promise.reject(new Error('R2 is down')) } as unknown as R2Bucket,
+          minAgeMs: 0,
+          minSize: 0,
+          intervalMs: 0,
+        },
+      },
+      async (fs, state) => {
+        await fs.writeFile('/a', 'x')
+        // As when the alarm fires
+        await state.storage.deleteAlarm()
+        claimAlarm(state.storage)
+        await expect(fs.alarm()).rejects.toThrow('R2 is down')
+        expect(await nextAlarm(state)).not.toBeNull()
+      }
+    ))
+})
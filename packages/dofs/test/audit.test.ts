@@ -0,0 +1,43 @@
+import { describe, expect, it } from 'vitest'
+import { withFs } from './helpers.js'
+
+describe('audit', () => {
+  it('records changes with the actor and uid', () =>
+    withFs({ audit: true }, async (fs) => {
+      fs.mkdir('/shared', { mode: 0o777 })
+      const aliceFs = fs.withContext({ actor: 'alice' }).withCredentials({ uid: 1000, gid: 1000 })
+      await aliceFs.writeFile('/shared/a', 'x')
+      expect(() => aliceFs.unlink('/missing')).toThrow(/^ENOENT/)
+      expect(fs.getAuditLog({ actor: 'alice' }).entries).toMatchObject([
+        { actor: 'alice', uid: 1000, method: 'writeFile', path: '/shared/a', bytes: 1, result: 'ok' },
+        { actor: 'alice', uid: 1000, method: 'unlink', path: '/missing', result: 'ENOENT' },
+      ])
+    }))
+
+  it('only lets root set the actor', () =>
+    withFs({ audit: true }, async (fs) => {
+      const aliceFs = fs.withContext({ actor: 'alice' }).withCredentials({ uid: 1000, gid: 1000 })
+      expect(() => aliceFs.withContext({ actor: 'bob' })).toThrow(/^EPERM/)
+      expect(() => fs.withCredentials({ uid: 1000, gid: 1000 }).withContext({ actor: 'bob' })).toThrow(/^EPERM/)
+    }))
+
+  it("doesn't record or count the filesystem's own work", () =>
+    withFs({ audit: true, trash: { retentionMs: 0 }, versioning: { maxAgeMs: 0 } }, async (fs) => {
+      await fs.writeFile('/expiring', 'x', { ttlMs: 0 })
+      await fs.writeFile('/versioned', 'one')
+      await fs.writeFile('/versioned', 'two')
+      await fs.writeFile('/trashed', 'x')
+      fs.unlink('/trashed')
+      fs.fsck({ background: true })
+      const entries = fs.getAuditLog().entries.length
+      const calls = Object.values(fs.getMetrics().methods).reduce((total, method) => total + method.calls, 0)
+      await fs.alarm()
+      expect(() => fs.stat('/expiring')).toThrow(/^ENOENT/)
+      expect(fs.listTrash()).toHaveLength(0)
+      expect(fs.listVersions('/versioned')).toHaveLength(0)
+      expect(fs.getAuditLog().entries).toHaveLength(entries)
+      const after = Object.values(fs.getMetrics().methods).reduce((total, method) => total + method.calls, 0)
+      // Only the stat, listTrash, listVersions and getAuditLog calls above
+      expect(after).toBe(calls + 4)
+    }))
+})
@@ -0,0 +1,6 @@
+declare module 'cloudflare:test' {
+  interface ProvidedEnv {
+    TEST_OBJECT: DurableObjectNamespace<import('./worker').TestObject>
+    COLD: R2Bucket
+  }
+}
@@ -0,0 +1,22 @@
+import { describe, expect, it } from 'vitest'
+import { FileType } from '../src/Fs.js'
+import { withFs } from './helpers.js'
+
+describe('find', () => {
+  it('filters by type', () =>
+    withFs(undefined, async (fs) => {
+      fs.mkdir('/d')
+      await fs.writeFile('/d/f', 'x')
+      fs.symlink('/d/f', '/d/link')
+      expect(fs.find('/', { type: 'file' }).entries.map((e) => e.path)).toEqual(['/d/f'])
+      expect(fs.find('/', { type: 'symlink' }).entries.map((e) => e.path)).toEqual(['/d/link'])
+      expect(fs.find('/', { type: 'directory' }).entries.map((e) => e.path)).toEqual(['/d'])
+    }))
+
+  it('rejects unknown types', () =>
+    withFs(undefined, async (fs) => {
+      for (const type of ['File', 'dir', 'toString']) {
+        expect(() => fs.find('/', { type: type as FileType })).toThrow(/^EINVAL/)
+      }
+    }))
+})
@@ -0,0 +1,15 @@
+import { env, runInDurableObject } from 'cloudflare:test'
+import { Fs, FsOptions } from '../src/Fs.js'
+
+// Run fn against an Fs on a fresh Durable Object's storage
+export const withFs = <T>(
+  options: FsOptions | undefined,
+  fn: (fs: Fs, state: DurableObjectState) => T | Promise<T>
+): Promise<T> => {
+  const stub = env.TEST_OBJECT.get(env.TEST_OBJECT.newUniqueId())
+  return runInDurableObject(stub, (_instance, state) => fn(new Fs(state, env, options), state))
+}
+
+export const text = (data: ArrayBuffer) => new TextDecoder().decode(data)
+
+export const readText = (stream: ReadableStream<Uint8Array>) => new Response(stream).text()
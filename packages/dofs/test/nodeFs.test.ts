@@ -0,0 +1,20 @@
+import { describe, expect, it } from 'vitest'
+import { createNodeFs } from '../src/nodeFs.js'
+import { withFs } from './helpers.js'
+
+describe('nodeFs', () => {
+  // A raw FsError would have a positive errno; Node's errors have it negated
+  it('rejects file handle calls on a closed or read-only handle with Node errors', () =>
+    withFs(undefined, async (fs) => {
+      const nodeFs = createNodeFs(fs)
+      await nodeFs.writeFile('/f', 'x')
+      const handle = await nodeFs.open('/f', 'r')
+      await expect(handle.writeFile('y')).rejects.toMatchObject({ code: 'EBADF', errno: -9, syscall: 'write' })
+      await expect(handle.appendFile('y')).rejects.toMatchObject({ code: 'EBADF', errno: -9, syscall: 'write' })
+      await expect(handle.truncate()).rejects.toMatchObject({ code: 'EBADF', errno: -9, syscall: 'ftruncate' })
+      await handle.close()
+      await expect(handle.readFile()).rejects.toMatchObject({ code: 'EBADF', errno: -9, syscall: 'read' })
+      await expect(handle.stat()).rejects.toMatchObject({ code: 'EBADF', errno: -9, syscall: 'fstat' })
+      await expect(handle.sync()).rejects.toMatchObject({ code: 'EBADF', errno: -9, syscall: 'fsync' })
+    }))
+})
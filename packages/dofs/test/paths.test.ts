@@ -0,0 +1,69 @@
+import { env } from 'cloudflare:test'
+import { describe, expect, it } from 'vitest'
+import { Fs } from '../src/Fs.js'
+import { OverlayFs } from '../src/OverlayFs.js'
+import { readText, withFs } from './helpers.js'
+
+describe('paths', () => {
+  it("resolves '..' after a symlink from the target's parent", () =>
+    withFs(undefined, async (fs) => {
+      fs.mkdir('/a/b', { recursive: true })
+      await fs.writeFile('/a/x', 'target side')
+      await fs.writeFile('/x', 'link side')
+      fs.symlink('/a/b', '/link')
+      expect(await readText(fs.readFile('/link/../x'))).toBe('target side')
+      expect(fs.realpath('/link/..')).toBe('/a')
+      expect(fs.realpath('/a/../../a/./b')).toBe('/a/b')
+    }))
+
+  it("won't create or remove an entry through '..'", () =>
+    withFs(undefined, async (fs) => {
+      fs.mkdir('/a/b', { recursive: true })
+      expect(() => fs.mkdir('/a/b/..')).toThrow(/^EEXIST/)
+      expect(() => fs.symlink('/x', '/a/..')).toThrow(/^EEXIST/)
+      expect(() => fs.rmdir('/a/b/..')).toThrow(/^ENOTEMPTY/)
+      expect(() => fs.unlink('/a/b/..')).toThrow(/^EISDIR/)
+      fs.mkdir('/c/d/..', { recursive: true })
+      expect(fs.stat('/c/d').isDirectory).toBe(true)
+    }))
+
+  it('records the physical path of trashed entries', () =>
+    withFs({ trash: true }, async (fs) => {
+      fs.mkdir('/a/b', { recursive: true })
+      await fs.writeFile('/a/f', 'x')
+      fs.symlink('/a/b', '/link')
+      fs.unlink('/link/../f')
+      expect(fs.listTrash().map((entry) => entry.path)).toEqual(['/a/f'])
+    }))
+
+  it('refuses to copy a directory into itself through a symlink', () =>
+    withFs(undefined, async (fs) => {
+      fs.mkdir('/a/b', { recursive: true })
+      fs.symlink('/a/b', '/link')
+      expect(() => fs.cp('/a', '/link/copy', { recursive: true })).toThrow(/^EINVAL/)
+    }))
+
+  it("takes '..' textually in an overlay", () =>
+    withFs({ volume: 'lower' }, async (lower, state) => {
+      lower.mkdir('/a')
+      await lower.writeFile('/a/f', 'lower')
+      const overlay = new OverlayFs(lower, new Fs(state, env, { volume: 'upper' }))
+      await overlay.writeFile('/a/../a/g', 'upper')
+      expect((await overlay.listDir('/a')).sort()).toEqual(['.', '..', 'f', 'g'])
+    }))
+
+  it("writes through a dangling symlink by creating the link's target", () =>
+    withFs(undefined, async (fs) => {
+      fs.mkdir('/dir')
+      fs.symlink('/dir/absolute', '/abs')
+      fs.symlink('relative', '/dir/rel')
+      fs.symlink('rel', '/dir/chain')
+      await fs.writeFile('/abs', 'a')
+      await fs.writeFile('/dir/chain', 'r')
+      expect(await readText(fs.readFile('/dir/absolute'))).toBe('a')
+      expect(await readText(fs.readFile('/dir/relative'))).toBe('r')
+      expect(fs.lstat('/abs').kind).toBe('Symlink')
+      fs.symlink('/missing/file', '/broken')
+      await expect(fs.writeFile('/broken', 'x')).rejects.toThrow(/^ENOENT/)
+    }))
+})
@@ -0,0 +1,90 @@
+import { describe, expect, it } from 'vitest'
+import { Fs, R_OK, W_OK } from '../src/Fs.js'
+import { text, withFs } from './helpers.js'
+
+const alice = { uid: 1000, gid: 1000 }
+const bob = { uid: 1001, gid: 1001 }
+
+// Give alice a home directory with a private file and a world-readable one
+const setup = async (fs: Fs) => {
+  fs.mkdir('/home/alice', { recursive: true })
+  fs.setattr('/home/alice', { uid: alice.uid, gid: alice.gid })
+  const aliceFs = fs.withCredentials(alice)
+  await aliceFs.writeFile('/home/alice/private', 'secret')
+  aliceFs.setattr('/home/alice/private', { mode: 0o600 })
+  await aliceFs.writeFile('/home/alice/public', 'hello')
+  return { aliceFs, bobFs: fs.withCredentials(bob) }
+}
+
+describe('permissions', () => {
+  it('enforces read and write permission on files', () =>
+    withFs(undefined, async (fs) => {
+      const { aliceFs, bobFs } = await setup(fs)
+      expect(text(await aliceFs.read('/home/alice/private', {}))).toBe('secret')
+      await expect(bobFs.read('/home/alice/private', {})).rejects.toThrow(/^EACCES/)
+      expect(text(await bobFs.read('/home/alice/public', {}))).toBe('hello')
+      await expect(bobFs.write('/home/alice/public', 'x', { offset: 0 })).rejects.toThrow(/^EACCES/)
+      bobFs.access('/home/alice/public', R_OK)
+      expect(() => bobFs.access('/home/alice/public', W_OK)).toThrow(/^EACCES/)
+    }))
+
+  it('requires write permission on the parent to create or remove entries', () =>
+    withFs(undefined, async (fs) => {
+      const { bobFs } = await setup(fs)
+      await expect(bobFs.writeFile('/home/alice/new', 'x')).rejects.toThrow(/^EACCES/)
+      expect(() => bobFs.mkdir('/home/alice/dir')).toThrow(/^EACCES/)
+      expect(() => bobFs.unlink('/home/alice/public')).toThrow(/^EACCES/)
+      expect(() => bobFs.rename('/home/alice/public', '/home/alice/moved')).toThrow(/^EACCES/)
+    }))
+
+  it('requires search permission on every directory along the path', () =>
+    withFs(undefined, async (fs) => {
+      const { aliceFs, bobFs } = await setup(fs)
+      aliceFs.setattr('/home/alice', { mode: 0o700 })
+      expect(() => bobFs.stat('/home/alice/public')).toThrow(/^EACCES/)
+      await expect(bobFs.read('/home/alice/public', {})).rejects.toThrow(/^EACCES/)
+    }))
+
+  it('only lets the owner chmod and root chown', () =>
+    withFs(undefined, async (fs) => {
+      const { aliceFs, bobFs } = await setup(fs)
+      expect(() => bobFs.setattr('/home/alice/public', { mode: 0o666 })).toThrow(/^EPERM/)
+      expect(() => aliceFs.setattr('/home/alice/public', { uid: bob.uid })).toThrow(/^EPERM/)
+      fs.setattr('/home/alice/public', { uid: bob.uid })
+      expect(fs.stat('/home/alice/public').uid).toBe(bob.uid)
+    }))
+
+  it('requires search permission above an inode looked up by number', () =>
+    withFs(undefined, async (fs) => {
+      const { aliceFs, bobFs } = await setup(fs)
+      const { ino } = fs.stat('/home/alice/public')
+      const { ino: home } = fs.stat('/home/alice')
+      expect(bobFs.pathOf(ino!)).toBe('/home/alice/public')
+      aliceFs.setattr('/home/alice', { mode: 0o700 })
+      expect(() => bobFs.statInode(ino!)).toThrow(/^EACCES/)
+      expect(() => bobFs.pathOf(ino!)).toThrow(/^EACCES/)
+      expect(() => bobFs.lookup(home!, 'public')).toThrow(/^EACCES/)
+      fs.setattr('/home', { mode: 0o700 })
+      expect(() => bobFs.statInode(home!)).toThrow(/^EACCES/)
+      expect(() => aliceFs.pathOf(ino!)).toThrow(/^EACCES/)
+      expect(fs.pathOf(ino!)).toBe('/home/alice/public')
+    }))
+
+  it('only lets owners remove entries from sticky directories', () =>
+    withFs(undefined, async (fs) => {
+      const { aliceFs, bobFs } = await setup(fs)
+      fs.mkdir('/tmp', { mode: 0o1777 })
+      await aliceFs.writeFile('/tmp/a', 'x')
+      expect(() => bobFs.unlink('/tmp/a')).toThrow(/^EPERM/)
+      aliceFs.unlink('/tmp/a')
+      expect(() => fs.stat('/tmp/a')).toThrow(/^ENOENT/)
+    }))
+
+  it('only lets root change credentials', () =>
+    withFs(undefined, async (fs) => {
+      const { bobFs } = await setup(fs)
+      expect(() => bobFs.withCredentials({ uid: 0, gid: 0 })).toThrow(/^EPERM/)
+      expect(() => bobFs.withCredentials({ ...bob, groups: [0] })).toThrow(/^EPERM/)
+      expect(() => fs.withCredentials(bob).withCredentials(alice)).toThrow(/^EPERM/)
+    }))
+})
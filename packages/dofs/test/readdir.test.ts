@@ -0,0 +1,34 @@
+import { describe, expect, it } from 'vitest'
+import { ReaddirSort } from '../src/Fs.js'
+import { withFs } from './helpers.js'
+
+describe('readdir', () => {
+  it('sorts by the given key and pages with a cursor', () =>
+    withFs(undefined, async (fs) => {
+      await fs.writeFile('/b', 'x')
+      await fs.writeFile('/a', 'xxx')
+      await fs.writeFile('/c', 'xx')
+      expect(fs.readdir('/').entries.map((e) => e.name)).toEqual(['a', 'b', 'c'])
+      const first = fs.readdir('/', { sort: 'size', limit: 2 })
+      expect(first.entries.map((e) => e.name)).toEqual(['b', 'c'])
+      const rest = fs.readdir('/', { sort: 'size', limit: 2, cursor: first.cursor })
+      expect(rest.entries.map((e) => e.name)).toEqual(['a'])
+      expect(rest.cursor).toBeUndefined()
+    }))
+
+  it('rejects sort keys other than name, mtime and size', () =>
+    withFs(undefined, async (fs) => {
+      await fs.writeFile('/a', 'x')
+      for (const sort of ["size') FROM dofs_meta --", 'uid', 'toString']) {
+        expect(() => fs.readdir('/', { sort: sort as ReaddirSort })).toThrow(/^EINVAL/)
+      }
+    }))
+
+  it('rejects a cursor from a different sort', () =>
+    withFs(undefined, async (fs) => {
+      await fs.writeFile('/a', 'x')
+      await fs.writeFile('/b', 'x')
+      const { cursor } = fs.readdir('/', { sort: 'size', limit: 1 })
+      expect(() => fs.readdir('/', { sort: 'mtime', cursor })).toThrow(/^EINVAL/)
+    }))
+})
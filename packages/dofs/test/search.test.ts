@@ -0,0 +1,20 @@
+import { describe, expect, it } from 'vitest'
+import { withFs } from './helpers.js'
+
+describe('search', () => {
+  it("fills the page with matches the caller can read, skipping ones they can't", () =>
+    withFs({ indexText: true }, async (fs) => {
+      for (const name of ['a', 'b', 'c', 'd']) {
+        await fs.writeFile(`/${name}`, 'the quick brown fox')
+        fs.setattr(`/${name}`, { mode: 0o600 })
+      }
+      await fs.writeFile('/open1', 'the quick brown fox')
+      await fs.writeFile('/open2', 'the quick brown fox')
+      const aliceFs = fs.withCredentials({ uid: 1000, gid: 1000 })
+      const first = aliceFs.search('fox', { limit: 1 })
+      expect(first.map((result) => result.path)).toHaveLength(1)
+      const all = aliceFs.search('fox', { limit: 2 })
+      expect(all.map((result) => result.path).sort()).toEqual(['/open1', '/open2'])
+      expect(fs.search('fox', { limit: 10 })).toHaveLength(6)
+    }))
+})
@@ -0,0 +1,44 @@
+import { env } from 'cloudflare:test'
+import { describe, expect, it } from 'vitest'
+import { readText, text, withFs } from './helpers.js'
+
+// Every file is cold straight away, so tier() moves all of its chunks to Miniflare's local R2
+const options = { chunkSize: 4, checksums: true, tiering: { bucket: env.COLD, minAgeMs: 0, minSize: 0 } }
+
+describe('tiering', () => {
+  it('moves cold chunks to R2 and reads them back', () =>
+    withFs(options, async (fs) => {
+      await fs.writeFile('/a', 'hello world')
+      expect(await fs.tier()).toBe(3)
+      expect((await env.COLD.list()).objects).toHaveLength(3)
+      expect(fs.getDeviceStats().tieredBytes).toBe(11)
+      expect(text(await fs.read('/a', { offset: 2, length: 6 }))).toBe('llo wo')
+      expect(await readText(fs.readFile('/a'))).toBe('hello world')
+      expect((await fs.verify('/a')).ok).toBe(true)
+    }))
+
+  it('brings back a chunk that is partly overwritten', () =>
+    withFs(options, async (fs) => {
+      await fs.writeFile('/a', 'hello world')
+      await fs.tier()
+      await fs.write('/a', 'XY', { offset: 5 })
+      expect(text(await fs.read('/a', {}))).toBe('helloXYorld')
+    }))
+
+  it('keeps the tiered bytes before the new end when truncating', () =>
+    withFs(options, async (fs) => {
+      await fs.writeFile('/a', 'hello world')
+      await fs.tier()
+      await fs.truncate('/a', 6)
+      expect(text(await fs.read('/a', {}))).toBe('hello ')
+    }))
+
+  it('deletes objects no chunk refers to any more', () =>
+    withFs(options, async (fs) => {
+      await fs.writeFile('/a', 'hello world')
+      await fs.tier()
+      fs.unlink('/a')
+      await fs.alarm()
+      expect((await env.COLD.list()).objects).toHaveLength(0)
+    }))
+})
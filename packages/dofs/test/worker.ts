@@ -0,0 +1,10 @@
+import { DurableObject } from 'cloudflare:workers'
+
+// Tests build an Fs on this object's storage with runInDurableObject()
+export class TestObject extends DurableObject {}
+
+export default {
+  async fetch() {
+    return new Response('Not found', { status: 404 })
+  },
+}
@@ -0,0 +1,12 @@
+import { defineWorkersConfig } from '@cloudflare/vitest-pool-workers/config'
+
+export default defineWorkersConfig({
+  test: {
+    include: ['test/**/*.test.ts'],
+    poolOptions: {
+      workers: {
+        wrangler: { configPath: './test/wrangler.jsonc' },
+      },
+    },
+  },
+})